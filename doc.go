@@ -1,8 +1,8 @@
 // Package notify is a simplistic notification/logging service used in HalcyonFlux/fractal.
 //
-// Use a function created by notifier.Sender or notifier.Failure to send and
-// log notifications. notify.Sender understands string, notify.notification types
-// and the errors.error interface.
+// Use a function created by notifier.Sender or notifier.Failure (or
+// notify.Send) to send and log notifications. Send functions understand
+// string, notify.notification types and the errors.error interface.
 //
 // Use notifier.Run() either sequentially or in a goroutine to run the service.
 //
@@ -1,37 +1,301 @@
 package notify
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Notifier struct {
-	service           string            // Service that uses the notifier (e.g. fractal-beacon)
-	instance          string            // Unique instance name of the service (e.g. beacon_server_01)
-	logAll            bool              // If true, also logs non-error messages
-	noteChan          chan *note        // Channel the notifier listens on
-	notificationCodes map[int][2]string // Map of notification codes and their meanings
-	async             bool              // Indicator of whether notify.send should start goroutines or potentially block
-	json              bool              // Indicator of whether logs should be written as json (each line a json object)
-	ops               operations        // Lockable operations indicator
-	endpoints         endpoints         // Lockable slice of resources
+	service           string                        // Service that uses the notifier (e.g. fractal-beacon)
+	instance          string                        // Unique instance name of the service (e.g. beacon_server_01)
+	logAll            bool                          // If true, also logs non-error messages (guarded by the verbosity lock)
+	noteChan          chan *note                    // Channel the notifier listens on
+	notificationCodes map[int][2]string             // Map of notification codes and their meanings (replaced under codesLock on a running notifier)
+	codesLock         sync.RWMutex                  // Lock the replacement of notificationCodes by notifier.LoadCodes
+	async             bool                          // Indicator of whether notify.send should start goroutines or potentially block
+	json              bool                          // Indicator of whether logs should be written as json (each line a json object)
+	ops               operations                    // Lockable operations indicator
+	endpoints         endpoints                     // Lockable slice of resources
+	fatalCode         int                           // Exit code used by notifier.Fatal
+	includeFunc       bool                          // Indicator of whether the calling function should be logged
+	fallback          *os.File                      // Endpoint receiving log lines that could not be written (guarded by the endpoints lock)
+	stats             statistics                    // Lockable notifier statistics
+	abort             chan struct{}                 // Closed once the exit grace period has expired
+	pause             pause                         // Lockable pause indicator
+	pool              asyncPool                     // Workers of asynchronous sends
+	verbosity         verbosity                     // Lockable level threshold and lock of logAll
+	maxLineLen        int                           // Maximum length of a text log line (0: unlimited)
+	noop              bool                          // Indicator of whether the notifier discards all notes
+	templates         map[int]string                // Message templates of notification codes
+	digests           map[int]*digest               // Digests of notification codes (used by notifier.Run only)
+	registered        bool                          // Indicator of whether service and instance are registered
+	formatter         Formatter                     // Custom formatter of log entries (optional)
+	chanLock          sync.RWMutex                  // Lock the reference to the note channel (replaced by notifier.Resize)
+	resized           chan struct{}                 // Wakes up notifier.Run() waiting on a replaced note channel
+	retired           []chan *note                  // Replaced note channels notifier.Run() empties first (guarded by chanLock)
+	panicHandler      func(interface{}, LogEntry)   // Handler of panics recovered while logging (optional)
+	formatTimeout     time.Duration                 // Maximum time spent formatting an entry (0: no limit)
+	senderNormalizer  func(string) string           // Transformation of sender names at log time (optional)
+	callerInfo        func(string) string           // Transformation of caller locations at log time (optional)
+	routeWarnings     bool                          // Indicator of whether internal warnings should be logged
+	maxCode           int                           // Upper bound of replaceable notification codes (exclusive)
+	utc               bool                          // Indicator of whether entry times are in UTC (default: JSON output only)
+	lastWrite         int64                         // Time of the latest successful write in nanoseconds (atomic)
+	samplers          map[int]*sampler              // Samplers of notification codes (used by notifier.Run only)
+	stackMinCode      int                           // Lowest code whose entries carry stack frames
+	stackDepth        int                           // Maximum number of stack frames (0: no stack frames)
+	now               func() time.Time              // Clock of the notifier
+	rotation          *schedule                     // Rotation schedule of the log files (optional)
+	nextRotation      time.Time                     // Time of the next rotation (used by notifier.Run only)
+	batchSize         int                           // Number of entries written to endpoints at once (0: no batching)
+	batchInterval     time.Duration                 // Maximum time entries are held in the batch
+	batch             batch                         // Formatted entries not written yet (guarded by the endpoints lock)
+	fileBuffer        int                           // Buffer size of the log files opened by the notifier (0: unbuffered)
+	fileFlushInterval time.Duration                 // Interval between flushes of buffered log files
+	compressRotated   bool                          // Indicator of whether rotated log files are gzipped
+	keepCompressed    int                           // Number of compressed backups kept per log file (0: all)
+	compressions      sync.WaitGroup                // Running compressions of rotated log files
+	compressLock      sync.Mutex                    // Serialize compressions and the pruning of backups
+	remap             remap                         // Lockable remapping of notification codes
+	exitLock          sync.Mutex                    // Serialize notifier.Exit calls
+	exited            bool                          // Set by the first notifier.Exit call (guarded by exitLock)
+	includeGoroutine  bool                          // Indicator of whether the id of the sending goroutine should be logged
+	includeSeq        bool                          // Indicator of whether entries should be numbered
+	fileHeader        bool                          // Indicator of whether new log files should start with a header line
+	healthBacklog     int                           // Backlog reported as saturated by notifier.Health (0: capacity)
+	exitSummary       bool                          // Indicator of whether the last note carries a summary (see notifier.SetExitSummary)
+	quietExit         bool                          // Indicator of whether the last note is not logged (see notifier.SetQuietExit)
+	array             jsonArray                     // JSON arrays of the endpoints (see notifier.SetJSONArray)
+	started           time.Time                     // Time notifier.Run() started (clock of the notifier, only set for exit summaries)
+	seq               int64                         // Sequence number of the latest numbered entry (atomic)
+	fieldProvider     func() map[string]interface{} // Provider of ambient fields, called by senders (optional)
+	parseLevelPrefix  bool                          // Indicator of whether level tags of messages are parsed (e.g. "[ERROR] ...")
+	levelPrefixes     map[string]int                // Codes of level tags (default: defaultLevelPrefixes)
+	onLog             []func(LogEntry)              // Callbacks of logged entries (guarded by the endpoints lock)
+	maxMessageLen     int                           // Maximum length of messages and string field values (0: unlimited)
+	multiline         MultilineMode                 // Handling of line breaks of text messages
+	stdSplit          StdSplitMode                  // Writing of entries to the standard streams by level
+	ready             chan struct{}                 // Closed once notifier.Run() has started
+	done              chan struct{}                 // Closed once notifier.Exit() has closed the endpoints
 }
 
+// Service is the interface of a notification service. Consumers can depend on
+// it instead of *Notifier, so that fakes or the discard notifier (see
+// NewDiscardNotifier) can be injected.
+type Service interface {
+	Sender(sender string) func(interface{}) error
+	Failure(sender string) func(int, string, ...interface{}) error
+	SendSync(sender string, value interface{}) error
+	SendChange(sender string, field string, oldValue interface{}, newValue interface{}) error
+	Writer(sender string) io.Writer
+	SetCodes(newCodes map[int][2]string) error
+	AddEndpoint(endpoint interface{}) error
+	RemoveEndpoint(endpoint interface{}) error
+	Run()
+	WarmUp()
+	Exit() error
+}
+
+var _ Service = (*Notifier)(nil)
+
+// Stats contains the counters of a notifier
+type Stats struct {
+	WriteFailures int            // Number of log lines that could not be written to an endpoint
+	Dropped       int            // Number of entries dropped by sampling
+	Errors        int            // Number of logged entries of level ERR (see notifier.ErrorCount)
+	Entries       int            // Number of logged entries
+	Levels        map[string]int // Number of logged entries per level
+}
+
+// LogEntry is a single entry of the log. It is passed to custom formatters
+// (see Formatter) and panic handlers, and decoded by LogReader.
+type LogEntry struct {
+	Timestamp int                    `json:"Timestamp"`
+	Service   string                 `json:"Service"`
+	Instance  string                 `json:"Instance"`
+	Sender    string                 `json:"Sender"`
+	Level     string                 `json:"Level"`
+	Code      int                    `json:"Code"`
+	OrigCode  int                    `json:"OrigCode,omitempty"` // Code before remapping (see notifier.SetCodeRemap)
+	Status    string                 `json:"Status"`
+	Message   string                 `json:"Message"`
+	Func      string                 `json:"Func,omitempty"`
+	Caller    string                 `json:"Caller,omitempty"`    // Location of the fail function call, e.g. main.go:42
+	TraceID   string                 `json:"TraceID,omitempty"`   // Correlation ID of the sender (see notifier.SenderWithID)
+	Goroutine int64                  `json:"Goroutine,omitempty"` // ID of the sending goroutine (see notifier.SetIncludeGoroutine)
+	Seq       int64                  `json:"Seq,omitempty"`       // Sequence number of the entry (see notifier.SetIncludeSeq)
+	Fields    map[string]interface{} `json:"Fields,omitempty"`
+	Frames    []Frame                `json:"Frames,omitempty"`
+	Time      time.Time              `json:"-"` // Time of the entry (UTC or local time, see notifier.SetUTC)
+}
+
+// Frame is a stack frame of the function that sent a note
+// (see notifier.SetStructuredStack)
+type Frame struct {
+	Function string `json:"Function"`
+	File     string `json:"File"`
+	Line     int    `json:"Line"`
+}
+
+// MultilineMode determines how line breaks (and other separators) of messages
+// are written in text mode (see notifier.SetMultiline). JSON entries always
+// keep them, since they are escaped by the JSON encoding.
+type MultilineMode int
+
+const (
+	MultilineFlatten MultilineMode = iota // Replace separators by spaces (default)
+	MultilineEscape                       // Escape separators, e.g. a line break as \n (and \ as \\)
+	MultilineIndent                       // Keep line breaks, indenting continuation lines by a tab
+)
+
+// StdSplitMode determines whether entries are written to the standard streams
+// by level, independent of the endpoints (see notifier.SetStdSplit)
+type StdSplitMode int
+
+const (
+	StdSplitOff     StdSplitMode = iota // Write entries to the endpoints only (default)
+	StdSplitAlso                        // Write ERR entries to os.Stderr and other entries to os.Stdout, in addition to all endpoints
+	StdSplitInstead                     // Like StdSplitAlso, but skip os.Stdout and os.Stderr endpoints
+)
+
+// Formatter turns log entries into log lines. NeedsNewline indicates whether
+// the notifier should terminate each line with a line break; formatters that
+// manage their own framing return false.
+type Formatter interface {
+	Format(entry LogEntry) string
+	NeedsNewline() bool
+}
+
+// ErrNotifierClosed is returned by send functions if the note was rejected,
+// because the notifier has been stopped by notifier.Exit().
+var ErrNotifierClosed = errors.New("notify: notifier is closed")
+
+// ErrSendTimeout is returned by notifier.SendWithTimeout if the note channel
+// did not have free capacity in time. The note is not logged.
+var ErrSendTimeout = errors.New("notify: send timed out")
+
 // Error returns the notification text
 func (e notification) Error() string {
 	return e.message
 }
 
+// Unwrap returns the underlying error (see notifier.FailureErr), so that
+// errors.Is and errors.As can look through notifications
+func (e notification) Unwrap() error {
+	return e.cause
+}
+
 // IsCode checks whether the provided error has the error code %code%.
-// errors.error implementations that are not notify.notification are going are
-// treated as if having code=1.
+// errors.error implementations that are neither notify.notification nor Coder
+// are treated as if having code=1.
 func IsCode(code int, err error) bool {
-	if _, ok := err.(notification); ok {
-		return code == err.(notification).code
-	} else {
-		return code == 1
+	return code == errorCode(err)
+}
+
+// Coder is implemented by error types of other packages that carry a
+// notification code. Send and fail functions log such errors with their code
+// instead of code 1, provided it is a known code of the notifier. Errors with
+// unknown or non-positive codes are logged with code 1.
+type Coder interface {
+	Code() int
+}
+
+// Newf creates an error with a notification code, e.g. to return it from
+// functions or to send it with a send function. The message is formatted
+// according to the format specifier. The error is recognized by IsCode.
+func Newf(code int, format string, a ...interface{}) error {
+	return newf(code, 2, format, a...)
+}
+
+// New creates an error with a notification code and a message (see Newf)
+func New(code int, message string) error {
+	return newf(code, 2, "%s", message)
+}
+
+// Send sends a value (string, error or notification) as a note of the sender
+// to the notifier. It is equivalent to notifier.Sender(sender)(value), i.e.
+// errors are logged and returned, while notifications created by a fail
+// function are not sent twice.
+func Send(no *Notifier, sender string, value interface{}) error {
+
+	// Avoid double sends
+	if isSent(value) {
+		return nil
 	}
+
+	return no.send(no.newNote(sender, value, nil), no.async)
+}
+
+// ResetFileEndpointRegistry forgets all file endpoints used by notifiers, so
+// that the same log file can be attached again. It is meant to be used in test
+// suites between tests; files still opened by other notifiers are not closed.
+func ResetFileEndpointRegistry() {
+	usedFileEndpointsLock.Lock()
+	usedFileEndpoints = nil
+	usedFileEndpointsLock.Unlock()
+}
+
+// SetExitGrace sets the default grace period of notifier.Exit() for all
+// notifiers. Entries that have not been logged within the grace period are
+// dumped to the fallback endpoint. A zero duration (default) waits until the
+// whole backlog has been logged.
+func SetExitGrace(grace time.Duration) {
+	exitGrace.Lock()
+	exitGrace.period = grace
+	exitGrace.Unlock()
+}
+
+// SetInternalWarnWriter sets the writer receiving the notifier's internal
+// warnings (e.g. failed writes to an endpoint). Internal warnings are not
+// logged, to avoid recursion. Default: os.Stderr, nil disables them.
+func SetInternalWarnWriter(w io.Writer) {
+	internalWarnings.Lock()
+	internalWarnings.w = w
+	internalWarnings.Unlock()
+}
+
+// RegisterLevel adds a level to the levels accepted by notifier.SetCodes
+// (default: MSG, WRN and ERR).
+func RegisterLevel(level string) {
+	knownLevels.Lock()
+	knownLevels.levels[level] = true
+	knownLevels.Unlock()
+}
+
+// SetUniqueInstances enables warnings about notifiers sharing the same service
+// and instance names (disabled by default). Notifiers are deregistered on Exit.
+func SetUniqueInstances(enforce bool) {
+	usedInstances.Lock()
+	usedInstances.enforce = enforce
+	usedInstances.Unlock()
+}
+
+// EnvGatedEndpoint returns the endpoint if the environment variable envVar is
+// set to wantValue and nil otherwise. Nil endpoints are skipped by NewNotifier
+// and AddEndpoint, e.g. EnvGatedEndpoint(os.Stdout, "NOTIFY_ENV", "dev") adds
+// os.Stdout in development environments only.
+func EnvGatedEndpoint(w io.Writer, envVar string, wantValue string) io.Writer {
+	if os.Getenv(envVar) != wantValue {
+		return nil
+	}
+	return w
+}
+
+// NamedWriter names an endpoint, so that it can be addressed by its name
+// (e.g. notifier.FlushEndpoint). Log files are addressed by their path,
+// os.Stdout and os.Stderr by "stdout" and "stderr".
+func NamedWriter(name string, w io.Writer) io.Writer {
+	return &namedWriter{Writer: w, name: name}
 }
 
 // NewNotifier instantiates and returns a new notifier instance (notifier).
@@ -41,7 +305,7 @@ func IsCode(code int, err error) bool {
 // notifier.Exit(). This command will also exit a blocking Run().
 //
 // Accepted endpoints: string referenes to files (e.g. myservice.log) and
-// pointers to implementations of the os.File interface type (e.g. os.Stdout).
+// implementations of the io.Writer interface (e.g. os.Stdout).
 // Notes will be sent to all defined endpoints in their specified order.
 //
 // Other elements of the system can notify the user/write to log by creating and
@@ -51,60 +315,37 @@ func IsCode(code int, err error) bool {
 // non-blocking by instantiating it with async=true. This will make all send
 // and fail commands non-blocking, but the order of log entries cannot be
 // guaranteed, i.e. issuing two sends sequentially can result in reversed log entry
-// order. It is thus best to set a higher capacity of the notes channel at instantiation.
+// order (see notifier.SetAsyncWorkers and notifier.SetOrderedAsync). It is
+// thus best to set a higher capacity of the notes channel at instantiation.
 func NewNotifier(service string, instance string, logAll bool, async bool, json bool, notifierCap int, files ...interface{}) *Notifier {
 
 	// Initialize a bare notifier
 	no := Notifier{}
 
+	// Buffer log files (see notifier.SetFileBuffering)
+	no.fileBuffer = 4096
+	no.fileFlushInterval = time.Second
+
+	// Route asynchronous notes (see notifier.SetAsyncWorkers)
+	no.pool.workers = 4
+
 	// Prepare endpoints
 	if len(files) == 0 {
 		syswarn("No endpoints provided. Going to route all notes to os.Stdout")
 		files = []interface{}{os.Stdout}
 	}
 
-	endpointSlice := []*os.File{}
 	for i, endpoint := range files {
-
-	endSwitch:
-		switch w := endpoint.(type) {
-
-		case string:
-			f, err := openLogFile(w)
-
-			// disallow writing to the same file
-			if err == nil && f != os.Stdout {
-				for _, e := range usedFileEndpoints {
-					if e == w {
-						syswarn("File endpoint " + w + " is already used by another notifier!")
-						f.Close()
-						break endSwitch
-					}
-				}
-				usedFileEndpoints = append(usedFileEndpoints, w)
-			}
-
-			if err == nil || f == os.Stdout {
-				endpointSlice = append(endpointSlice, f)
-			}
-
-		case *os.File:
-			endpointSlice = append(endpointSlice, w)
-
-		default:
-			syswarn(strconv.Itoa(i+1) + "th endpoint is not supported. Either provide a file path (string) or an instance of *os.File")
+		if err := no.attach(endpoint); err != nil {
+			syswarn(strconv.Itoa(i+1) + "th endpoint: " + err.Error())
 		}
-
 	}
 
-	// Remove duplicates
-	dups := make(map[*os.File]bool)
-	for _, fi := range endpointSlice {
-		if _, ok := dups[fi]; !ok {
-			dups[fi] = true
-			no.endpoints.endpointsPtr = append(no.endpoints.endpointsPtr, fi)
-		}
+	// Detect notifiers sharing service and instance names
+	if !registerInstance(service, instance) && uniqueInstancesEnforced() {
+		syswarn("Service " + service + " instance " + instance + " is already used by another notifier!")
 	}
+	no.registered = true
 
 	// Set agent details
 	noteChan := make(chan *note, notifierCap)
@@ -112,15 +353,50 @@ func NewNotifier(service string, instance string, logAll bool, async bool, json
 	no.instance = instance
 	no.noteChan = noteChan
 	no.logAll = logAll
-	no.notificationCodes = standardCodes
+	no.notificationCodes = copyCodes(standardCodes)
 	no.async = async
 	no.json = json
+	no.utc = json
+	no.fatalCode = 1
+	no.maxCode = 999
+	no.now = time.Now
+	no.fallback = os.Stderr
+	no.abort = make(chan struct{})
+	no.ready = make(chan struct{})
+	no.resized = make(chan struct{}, 1)
+	no.done = make(chan struct{})
 	no.ops.halt = false
 	no.ops.running = false
 
 	return &no
 }
 
+// NoopNotifier returns a notifier that discards all notes without formatting
+// or writing them. Its send and fail functions still return errors, so that
+// the control flow of the caller is preserved. Run, WarmUp and Exit return
+// immediately and the ready channel is closed from the start.
+func NoopNotifier() *Notifier {
+	no := Notifier{}
+	no.noop = true
+	no.noteChan = make(chan *note)
+	no.notificationCodes = copyCodes(standardCodes)
+	no.fatalCode = 1
+	no.maxCode = 999
+	no.now = time.Now
+	no.abort = make(chan struct{})
+	no.ready = make(chan struct{})
+	close(no.ready)
+	return &no
+}
+
+// NewDiscardNotifier returns a notifier that accepts sends, but discards them
+// (see NoopNotifier). It can be injected in unit tests and disabled code paths
+// instead of redirecting os.Stdout. Errors are still returned by its send and
+// fail functions, so error propagation keeps working.
+func NewDiscardNotifier() *Notifier {
+	return NoopNotifier()
+}
+
 // Sender creates a simplified notify.send function, which requires
 // only the value of the message to be passed. Each unique sender (e.g. server,
 // client, etc.) should have their own personalized send.
@@ -129,8 +405,53 @@ func (no *Notifier) Sender(sender string) func(interface{}) error {
 		var err error
 
 		// Avoid double sends
-		if _, ok := value.(notification); !ok {
-			err = send(sender, value, nil, no.noteChan, no.async, &no.ops)
+		if !isSent(value) {
+			err = no.send(no.newNote(sender, value, nil), no.async)
+		}
+
+		return err
+	}
+}
+
+// SenderWithID creates a send function like notifier.Sender, whose notes
+// carry a correlation ID (e.g. of a request). The ID is logged as TraceID
+// (appended as trace_id=<id> in text mode). Empty IDs are omitted.
+func (no *Notifier) SenderWithID(sender string, traceID string) func(interface{}) error {
+	return func(value interface{}) error {
+		var err error
+
+		// Avoid double sends
+		if !isSent(value) {
+			n := no.newNote(sender, value, nil)
+			n.TraceID = traceID
+			err = no.send(n, no.async)
+		}
+
+		return err
+	}
+}
+
+// SenderCtx creates a send function like notifier.Sender, which takes the
+// context of a request along with the value. The values of the given context
+// keys are logged as structured fields named after the keys (fmt.Sprint(key)),
+// e.g. a trace ID or a user stored by a middleware. Keys missing from the
+// context are omitted.
+func (no *Notifier) SenderCtx(sender string, keys ...interface{}) func(context.Context, interface{}) error {
+	return func(ctx context.Context, value interface{}) error {
+		var err error
+
+		// Avoid double sends
+		if !isSent(value) {
+			n := no.newNote(sender, value, nil)
+			for _, key := range keys {
+				if v := ctx.Value(key); v != nil {
+					if n.Fields == nil {
+						n.Fields = make(map[string]interface{}, len(keys))
+					}
+					n.Fields[fmt.Sprint(key)] = v
+				}
+			}
+			err = no.send(n, no.async)
 		}
 
 		return err
@@ -143,135 +464,1580 @@ func (no *Notifier) Sender(sender string) func(interface{}) error {
 // personalized new and/or send functions.
 func (no *Notifier) Failure(sender string) func(int, string, ...interface{}) error {
 	return func(code int, format string, a ...interface{}) error {
-		err := send(sender, newf(code, 2, format, a...), nil, no.noteChan, no.async, &no.ops)
+
+		// Apply the code's message template
+		if template, ok := no.templates[code]; ok {
+			message := format
+			if len(a) > 0 {
+				message = fmt.Sprintf(format, a...)
+			}
+			format, a = template, []interface{}{message}
+		}
+
+		err := no.send(no.newNote(sender, newf(code, 2, format, a...), nil), no.async)
 		return err
 	}
 }
 
-// SetCodes replaces built-in notification codes with custom ones.
-// A partial replacement (e.g. codes 2-10) is also allowed, however only calls
-// to notifier.SetCodes of a non-active notifier are allowed. After executing
-// notifier.Run() a change of codes is not permited anymore.
-func (no *Notifier) SetCodes(newCodes map[int][2]string) error {
+// FailureErr creates a fail function like notifier.Failure, which keeps an
+// underlying error as the cause of the notification. The message is formatted
+// according to the format specifier and followed by the text of the error
+// (e.g. "open failed: permission denied"). The returned error carries the code
+// and unwraps to the cause, so errors.Is and errors.As keep working for
+// callers it is returned to. A nil error is logged like notifier.Failure.
+func (no *Notifier) FailureErr(sender string) func(int, error, string, ...interface{}) error {
+	return func(code int, err error, format string, a ...interface{}) error {
 
-	// Sanity check (will panic)
-	no.isOK()
+		message := format
+		if len(a) > 0 {
+			message = fmt.Sprintf(format, a...)
+		}
+		if err != nil {
+			message += ": " + err.Error()
+		}
 
-	if no.isReady() {
-		return newf(4, 1, "Cannot change codes on a running notifier")
+		// Apply the code's message template
+		if template, ok := no.templates[code]; ok {
+			message = fmt.Sprintf(template, message)
+		}
+
+		n := newf(code, 2, "%s", message).(notification)
+		n.cause = err
+		return no.send(no.newNote(sender, n, nil), no.async)
 	}
+}
 
-	// Change codes
-	fails := 0
-	for code, notification := range newCodes {
-		if code <= 1 || code >= 999 {
-			no.noteToSelf(newf(4, 1, "Only notification codes 1 < code < 999 are replaceable. Removing '%d'", code))
-			delete(newCodes, code)
-			fails++
-		} else {
-			no.notificationCodes[code] = notification
+// Coded creates a send function that logs any value (e.g. a string, an error
+// or a struct) with the code passed along, without a format string (see
+// notifier.Failure). Errors and fmt.Stringers are logged with their text, other
+// values in their default format (%v). Like the errors of notifier.Failure, the
+// returned error carries the code. Values already returned by a send function
+// are not sent again.
+func (no *Notifier) Coded(sender string) func(int, interface{}) error {
+	return func(code int, value interface{}) error {
+
+		// Avoid double sends
+		if isSent(value) {
+			return nil
+		}
+
+		var message string
+		switch v := value.(type) {
+		case string:
+			message = v
+		case error:
+			message = v.Error()
+		case fmt.Stringer:
+			message = v.String()
+		default:
+			message = fmt.Sprintf("%v", v)
+		}
+
+		// Apply the code's message template
+		if template, ok := no.templates[code]; ok {
+			message = fmt.Sprintf(template, message)
 		}
+
+		return no.send(no.newNote(sender, newf(code, 2, "%s", message), nil), no.async)
 	}
+}
 
-	if fails > 0 {
-		return newf(4, 1, "Failed replacing %d status codes: invalid range", fails)
-	} else {
+// Warn creates a simplified send function for warnings (code 5), which
+// requires only the message to be passed. Unlike messages, warnings are
+// logged regardless of logAll. Only ErrNotifierClosed is returned.
+func (no *Notifier) Warn(sender string) func(string, ...interface{}) error {
+	return func(format string, a ...interface{}) error {
+		if err := no.send(no.newNote(sender, newf(5, 2, format, a...), nil), no.async); err == ErrNotifierClosed {
+			return err
+		}
 		return nil
 	}
 }
 
-// Run logs messages sent to the note channel
-// Run is the only consumer of the note channel as well as the logging facility
-func (no *Notifier) Run() {
-
-	// Sanity check
-	no.isOK()
-
-	// Enable operations
-	no.ops.Lock()
-	no.ops.halt = false
-	no.ops.running = true
-	no.ops.Unlock()
+// Writer returns an io.Writer that sends each written line as a message
+// (code 0) of the sender. Incomplete lines are buffered until their line break
+// is written. This allows routing the output of the standard library's log
+// package through the notifier, e.g. log.SetOutput(notifier.Writer("legacy")).
+func (no *Notifier) Writer(sender string) io.Writer {
+	return &lineWriter{no: no, sender: sender}
+}
 
-	// Receive Notes
-	var n *note
-	var ok bool
+// SendChange logs the change of a field's value as a message with the
+// structured fields "field", "old" and "new".
+func (no *Notifier) SendChange(sender string, field string, oldValue interface{}, newValue interface{}) error {
+	n := no.newNote(sender, fmt.Sprintf("%s changed from %v to %v", field, oldValue, newValue), nil)
+	n.Fields = map[string]interface{}{"field": field, "old": oldValue, "new": newValue}
+	return no.send(n, no.async)
+}
 
-	no.endpoints.Lock()
-runLoop:
-	for {
+// SendBatch sends values of a sender as a single unit: they are logged in
+// order, without notes of other senders in between. Errors are converted to
+// notifications like in send functions. The first error among the values is
+// returned (or ErrNotifierClosed).
+func (no *Notifier) SendBatch(sender string, values []interface{}) error {
+	var first error
 
-		// Receive or halt notifier operations (send and newf won't work)
-		select {
-		case n, ok = <-no.noteChan:
-			if !ok {
-				no.endpoints.Unlock()
-				break runLoop
+	batch := make([]*note, 0, len(values))
+	for _, value := range values {
+		if err, ok := value.(error); ok {
+			if !isSent(value) {
+				value = newf(errorCode(err), 2, "%s", err.Error())
 			}
-		}
-
-		// Write to endpoints
-		switch (n.Value).(type) {
-		case string:
-			if no.logAll {
-				no.log(n)
+			if first == nil {
+				first = value.(error)
 			}
-		default:
-			no.log(n)
 		}
-
+		batch = append(batch, no.newNote(sender, value, nil))
 	}
-}
 
-// WarmUp waits until the notifier is ready.
-// This function is relevant only when notifier.Run() is started as a goroutine.
-func (no *Notifier) WarmUp() {
-	for !no.isReady() {
-		// Wait for the notifier to start
+	if err := no.send(&note{Sender: sender, Batch: batch}, no.async); err != nil {
+		return err
 	}
+	return first
 }
 
-// Exit closes the note channel and waits a little for the notifier to finish logging
-func (no *Notifier) Exit() error {
+// SendSync sends a value to the notifier and waits until it has been written
+// to all endpoints. SendSync blocks until notifier.Run() processes the note, so
+// it should only be used on a running notifier.
+func (no *Notifier) SendSync(sender string, value interface{}) error {
+	confirm := make(chan bool, 1)
+	err := no.send(no.newNote(sender, value, confirm), false)
+	<-confirm
+	return err
+}
 
-	var err error
+// SendWithTimeout sends a value to the notifier like a send function of a
+// synchronous notifier, but gives up if the note channel has no free capacity
+// within the timeout (e.g. because notifier.Run() is stalled). ErrSendTimeout
+// is returned in that case and the value is not logged. Otherwise, the note is
+// logged later on, like with any other send function. SendWithTimeout does not
+// start a goroutine, even if the notifier is asynchronous. The timeout must be
+// positive.
+func (no *Notifier) SendWithTimeout(sender string, value interface{}, timeout time.Duration) error {
+	if timeout <= 0 {
+		return newf(4, 1, "Timeout must be positive")
+	}
 
-	running := true
-	if !no.isReady() {
-		running = false
-		err = errors.New(no.id() + " was not running at exit time.")
+	// Avoid double sends
+	if isSent(value) {
+		return nil
 	}
 
-	// Halt operations and issue last log entry
-	if running {
-		no.ops.Lock()
-		no.ops.halt = true
-		confirm := make(chan bool)
-		no.noteChan <- &note{"notifier", "Exit() command has been executed. Stopping the notification service.", confirm}
-		no.ops.Unlock()
+	n := no.newNote(sender, value, nil)
+	n.Timeout = timeout
+	return no.send(n, false)
+}
+
+// Fatal logs a notification synchronously, exits the notifier (closing all
+// endpoints) and terminates the program with the exit code set by
+// notifier.SetFatalExitCode (default: 1). If the notifier is not running, the
+// notification is written to the endpoints directly.
+func (no *Notifier) Fatal(sender string, code int, format string, a ...interface{}) {
+	n := newf(code, 2, format, a...)
 
+	if no.isReady() {
+		confirm := make(chan bool, 1)
+		no.send(no.newNote(sender, n, confirm), false)
 		<-confirm
-		close(confirm)
-		close(no.noteChan)
 	} else {
-		no.ops.Lock()
-		no.ops.halt = true
-		no.ops.Unlock()
+		no.endpoints.Lock()
+		no.log(no.newNote(sender, n, nil))
+		no.endpoints.Unlock()
+	}
+
+	no.Exit()
+	osExit(no.fatalCode)
+}
+
+// SetFatalExitCode sets the exit code used by notifier.Fatal
+func (no *Notifier) SetFatalExitCode(code int) {
+	no.fatalCode = code
+}
+
+// SetIncludeFunc sets whether the name of the function that sends a note
+// should be logged (JSON field "Func"). The setting cannot be changed after
+// executing notifier.Run().
+func (no *Notifier) SetIncludeFunc(include bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the function names of entries on a running notifier")
+	}
+	no.includeFunc = include
+	return nil
+}
+
+// SetIncludeGoroutine sets whether the id of the goroutine that sends a note
+// should be logged (JSON field "Goroutine", appended as goroutine=<id> in text
+// mode), so that entries of goroutines sharing a sender can be grouped. The id
+// is parsed from the runtime's stack trace at send time. It is a best-effort
+// correlation aid, not a stable OS-level id, and adds some overhead to every
+// send. Disabled by default. The setting cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetIncludeGoroutine(include bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the goroutine ids of entries on a running notifier")
+	}
+	no.includeGoroutine = include
+	return nil
+}
+
+// SetIncludeSeq sets whether logged entries are numbered (JSON field "Seq",
+// appended as seq=<n> in text mode), so that consumers of shipped logs can
+// detect lost or reordered entries. Numbers start at 1 and increase by one for
+// every logged entry; entries skipped by logAll, the level
+// threshold, sampling or digests are not numbered. Sequences are kept per
+// notifier: entries of notifiers sharing an endpoint are numbered
+// independently. Disabled by default. The setting cannot be changed after
+// executing notifier.Run().
+func (no *Notifier) SetIncludeSeq(include bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the numbering of entries on a running notifier")
+	}
+	no.includeSeq = include
+	return nil
+}
+
+// SetRouteWarnings sets whether internal warnings of the notifier (e.g. a
+// format timeout) should be logged as notifications of code 998 instead of
+// being written to the internal warning sink (see SetInternalWarnWriter).
+// Warnings about failed writes to endpoints are never logged, to avoid
+// infinite recursion, and neither are warnings raised by NewNotifier or after
+// notifier.Exit(). The setting cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetRouteWarnings(route bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the routing of internal warnings on a running notifier")
+	}
+	no.routeWarnings = route
+	return nil
+}
+
+// SetClock sets the clock of the notifier, which provides the time of log
+// entries, of rotation schedules, of sampling and digest windows and of
+// notifier.LastWrite, e.g. a fixed or incrementing clock to assert on exact
+// timestamps in tests. A nil clock restores the default
+// (time.Now). The clock cannot be changed after executing notifier.Run().
+func (no *Notifier) SetClock(clock func() time.Time) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the clock of a running notifier")
+	}
+
+	if clock == nil {
+		clock = time.Now
+	}
+	no.now = clock
+	return nil
+}
+
+// SetUTC sets whether the time of log entries (LogEntry.Time, used by custom
+// formatters) is in UTC or local time. Defaults to UTC for JSON output and to
+// local time otherwise. The Unix timestamp is not affected. The setting cannot
+// be changed after executing notifier.Run().
+func (no *Notifier) SetUTC(utc bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the time zone of entries on a running notifier")
 	}
+	no.utc = utc
+	return nil
+}
+
+// SetStructuredStack makes entries of codes >= minCode (e.g. 1 for all
+// errors) carry up to depth stack frames of the sending function (JSON field
+// "Frames"). The frames are captured at send time. A depth <= 0 (default)
+// disables stack frames. The setting cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetStructuredStack(minCode int, depth int) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the stack frames of entries on a running notifier")
+	}
+	no.stackMinCode = minCode
+	no.stackDepth = depth
+	return nil
+}
 
-	// Close endpoints
+// SetFallback sets the endpoint receiving log lines that could not be written
+// to their intended endpoint (default: os.Stderr). Setting nil disables the
+// fallback. The fallback can be changed on a running notifier.
+func (no *Notifier) SetFallback(fallback *os.File) {
 	no.endpoints.Lock()
-	for _, endpoint := range no.endpoints.endpointsPtr {
-		if endpoint != os.Stdout {
-			endpoint.Close()
+	no.fallback = fallback
+	no.endpoints.Unlock()
+}
+
+// SetMaxLineLen limits the length (in bytes) of text log lines. Longer lines
+// are truncated and end with an ellipsis. JSON log lines are not truncated.
+// A limit <= 0 (default) disables truncation. The setting cannot be changed
+// after executing notifier.Run().
+func (no *Notifier) SetMaxLineLen(max int) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the length limit of lines on a running notifier")
+	}
+	no.maxLineLen = max
+	return nil
+}
+
+// SetMaxMessageLen limits the length (in bytes) of messages and string values
+// of structured fields in all formats. Longer values are cut (without
+// splitting UTF-8 characters) and followed by a marker of the number of
+// dropped bytes, e.g. "abc... (1021 bytes truncated)". A limit <= 0 (default)
+// disables truncation. The setting cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetMaxMessageLen(max int) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the length limit of messages on a running notifier")
+	}
+	no.maxMessageLen = max
+	return nil
+}
+
+// SetMultiline sets how line breaks of messages are written in text mode, e.g.
+// of stack traces. MultilineFlatten (default) and MultilineEscape keep one line
+// of 8 tab-separated fields per entry. MultilineIndent keeps the message
+// readable, but continues it on lines starting with a tab, which consumers
+// have to join (like LogReader does). The setting cannot be changed after
+// executing notifier.Run().
+func (no *Notifier) SetMultiline(mode MultilineMode) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the line breaks of messages on a running notifier")
+	}
+	no.multiline = mode
+	return nil
+}
+
+// SetStdSplit sets whether entries are written to the standard streams by
+// level, as CLI tools do to let shells redirect errors separately: entries of
+// level ERR go to os.Stderr and all other entries to os.Stdout. With
+// StdSplitAlso, entries are written to the standard streams in addition to
+// the endpoints (including os.Stdout and os.Stderr endpoints). With
+// StdSplitInstead, os.Stdout and os.Stderr endpoints are skipped, so that
+// entries are not written twice. Entries suppressed by the notifier (see
+// notifier.SetMinLevel) are not written either. The mode cannot be changed
+// after executing notifier.Run().
+func (no *Notifier) SetStdSplit(mode StdSplitMode) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the standard stream split on a running notifier")
+	}
+	if mode < StdSplitOff || mode > StdSplitInstead {
+		return newf(4, 1, "Unknown standard stream split mode %d", mode)
+	}
+
+	no.stdSplit = mode
+	return nil
+}
+
+// SetParseLevelPrefix sets whether messages (strings) starting with a level
+// tag, e.g. "[ERROR] disk full", are logged with the code of the tag and
+// without the tag. This bridges the output of libraries that tag their
+// messages. The default tags are ERROR and ERR (code 1), WARN and WARNING
+// (code 5), INFO and DEBUG (code 0). Tags are matched case-insensitively (see
+// notifier.SetLevelPrefixes). The setting cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetParseLevelPrefix(parse bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the parsing of level tags on a running notifier")
+	}
+	no.parseLevelPrefix = parse
+	return nil
+}
+
+// SetLevelPrefixes replaces the codes of level tags parsed by
+// notifier.SetParseLevelPrefix, e.g. map[string]int{"CRIT": 10}. Tags are
+// matched case-insensitively and all codes must be known. Setting nil restores
+// the default tags. The tags cannot be changed after executing notifier.Run().
+func (no *Notifier) SetLevelPrefixes(prefixes map[string]int) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change level prefixes on a running notifier")
+	}
+
+	if prefixes == nil {
+		no.levelPrefixes = nil
+		return nil
+	}
+
+	unknown := []int{}
+	levelPrefixes := make(map[string]int, len(prefixes))
+	for tag, code := range prefixes {
+		if _, ok := no.codes()[code]; !ok {
+			unknown = append(unknown, code)
 		}
+		levelPrefixes[strings.ToUpper(tag)] = code
 	}
+	if len(unknown) > 0 {
+		return newf(4, 1, "Cannot set level prefixes of unknown codes %s", joinCodes(unknown))
+	}
+
+	no.levelPrefixes = levelPrefixes
+	return nil
+}
+
+// OnLog registers a callback, which is called with every logged entry after it
+// has been formatted, e.g. to count entries in a metrics system. Callbacks are
+// called in the order of registration by notifier.Run(), so long callbacks
+// slow logging down; they must not send notes synchronously. Callbacks can be
+// registered on a running notifier.
+func (no *Notifier) OnLog(fn func(LogEntry)) {
+	no.endpoints.Lock()
+	no.onLog = append(no.onLog, fn)
 	no.endpoints.Unlock()
+}
 
-	// Set status
-	no.ops.Lock()
-	no.ops.running = false
-	no.ops.Unlock()
+// SetFieldProvider sets a provider of ambient structured fields (e.g. the ID
+// of the current request kept in a goroutine-local store), which is called at
+// send time in the goroutine of the sender. The provided fields are added to
+// the fields of each note; fields set by the sender (e.g. by
+// notifier.SendChange) take precedence. Setting nil removes the provider. Like
+// notifier.SetCodes, the provider cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetFieldProvider(provider func() map[string]interface{}) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the field provider on a running notifier")
+	}
+	no.fieldProvider = provider
+	return nil
+}
+
+// SetFormatter replaces the built-in text and JSON formats with a custom
+// formatter. Setting nil restores the built-in formats. Formatters cannot be
+// combined with JSON arrays (see notifier.SetJSONArray). Like
+// notifier.SetCodes, the formatter cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetFormatter(formatter Formatter) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the formatter on a running notifier")
+	}
+	if formatter != nil && no.array.enabled {
+		return newf(4, 1, "Cannot use a formatter with JSON arrays (see notifier.SetJSONArray)")
+	}
+	no.formatter = formatter
+	return nil
+}
+
+// SetFormatTimeout limits the time spent formatting a single entry. An entry
+// that is not formatted within the timeout is replaced by a fallback entry in
+// the built-in format with a truncated message, so that a pathological entry
+// cannot stall logging. A timeout <= 0 (default) disables the limit.
+func (no *Notifier) SetFormatTimeout(timeout time.Duration) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the format timeout on a running notifier")
+	}
+	no.formatTimeout = timeout
+	return nil
+}
+
+// SetSenderNormalizer sets a function transforming the sender of every entry
+// (e.g. strings.ToLower) before it is logged. The normalizer runs in
+// notifier.Run(), so it must be fast. Setting nil disables it. The normalizer
+// cannot be changed after executing notifier.Run().
+func (no *Notifier) SetSenderNormalizer(normalizer func(sender string) string) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the sender normalizer on a running notifier")
+	}
+	no.senderNormalizer = normalizer
+	return nil
+}
+
+// SetCallerInfo sets a function transforming the caller location of fail
+// functions and internal errors (LogEntry.Caller, appended as caller=<file:line>
+// in text mode) before it is logged, e.g. to produce stable output for golden
+// files. Returning an empty string drops the caller. Entries without a caller
+// are not affected. Setting nil (default) logs the location as is. The
+// function cannot be changed after executing notifier.Run().
+func (no *Notifier) SetCallerInfo(caller func(location string) string) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the caller info on a running notifier")
+	}
+	no.callerInfo = caller
+	return nil
+}
+
+// SetPanicHandler sets a function that is called with the recovered value and
+// the affected entry whenever a panic is recovered while logging (e.g. in a
+// formatter, an endpoint or a callback of notifier.OnLog). By default, a
+// code-999 entry is written to os.Stderr. Setting nil restores the default.
+// The setting cannot be changed after executing notifier.Run().
+func (no *Notifier) SetPanicHandler(handler func(recovered interface{}, entry LogEntry)) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the panic handler on a running notifier")
+	}
+	no.panicHandler = handler
+	return nil
+}
+
+// Backlog returns the number of notes waiting to be logged
+func (no *Notifier) Backlog() int {
+	no.chanLock.RLock()
+	defer no.chanLock.RUnlock()
+
+	backlog := len(no.noteChan)
+	for _, retired := range no.retired {
+		backlog += len(retired)
+	}
+	return backlog
+}
+
+// Capacity returns the capacity of the note channel
+func (no *Notifier) Capacity() int {
+	return cap(no.channel())
+}
+
+// Resize replaces the note channel with a channel of a different capacity.
+// Queued notes are logged in their original order: before notifier.Run() they
+// are moved to the new channel, afterwards notifier.Run() logs the notes left
+// in the old channel before receiving from the new one. The capacity cannot be
+// smaller than the current backlog.
+func (no *Notifier) Resize(capacity int) error {
+
+	// Block senders while the channels are swapped
+	no.ops.Lock()
+	defer no.ops.Unlock()
+
+	if no.ops.halt && no.ops.running {
+		return newf(4, 1, "Cannot resize an exiting notifier")
+	}
+
+	old := no.channel()
+	if capacity < len(old) {
+		return newf(4, 1, "Cannot resize the note channel to %d: backlog contains %d notes", capacity, len(old))
+	}
+
+	// notifier.Run() may be receiving from the old channel, so that only it can
+	// keep the order of the notes
+	noteChan := make(chan *note, capacity)
+	if !no.ops.running {
+	migrate:
+		for {
+			select {
+			case n := <-old:
+				noteChan <- n
+			default:
+				break migrate
+			}
+		}
+	}
+
+	no.chanLock.Lock()
+	if no.ops.running {
+		no.retired = append(no.retired, old)
+	}
+	no.noteChan = noteChan
+	no.chanLock.Unlock()
+
+	// Wake up notifier.Run() waiting on the old channel
+	select {
+	case no.resized <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// LastWrite returns the time the notifier last wrote an entry to at least one
+// endpoint (zero if it never did). A stale time indicates a wedged notifier.
+func (no *Notifier) LastWrite() time.Time {
+	nsec := atomic.LoadInt64(&no.lastWrite)
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+// SetQuietExit sets whether the last entry of notifier.Exit() ("Exit()
+// command has been executed. ...") is left out of the log. Exit still waits
+// until the backlog has been written and flushed before closing the
+// endpoints. An exit summary (see notifier.SetExitSummary) is logged anyway.
+// Disabled by default. The setting cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetQuietExit(quiet bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the quiet exit on a running notifier")
+	}
+	no.quietExit = quiet
+	return nil
+}
+
+// Stats returns a snapshot of the notifier's counters
+func (no *Notifier) Stats() Stats {
+	no.stats.Lock()
+	defer no.stats.Unlock()
+
+	stats := no.stats.Stats
+	stats.Levels = make(map[string]int, len(no.stats.Levels))
+	for level, count := range no.stats.Levels {
+		stats.Levels[level] = count
+	}
+	return stats
+}
+
+// SetExitSummary sets whether the last entry written by notifier.Exit()
+// carries a summary of the run as structured fields: the number of logged
+// entries in total ("entries") and per level (e.g. "err"), the duration since
+// notifier.Run() started ("duration"), and the numbers of entries dropped by
+// sampling ("dropped") and of failed writes ("write_failures"), e.g. for
+// batch jobs. The summary is logged even if messages are not (see
+// notifier.SetLogAll and notifier.SetMinLevel). Disabled by default. The
+// setting cannot be changed after executing notifier.Run().
+func (no *Notifier) SetExitSummary(summary bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the exit summary on a running notifier")
+	}
+	no.exitSummary = summary
+	return nil
+}
+
+// SetLogAll changes whether messages (level MSG) are logged, which is set by
+// the logAll argument of NewNotifier. It can be called on a running notifier,
+// e.g. to raise the verbosity of a live service from an admin endpoint, and
+// applies to the notes logged afterwards (see notifier.SetMinLevel).
+func (no *Notifier) SetLogAll(logAll bool) {
+	no.verbosity.Lock()
+	no.logAll = logAll
+	no.verbosity.Unlock()
+}
+
+// SetMinLevel skips entries of the built-in levels MSG, WRN and ERR that are
+// less severe than the level, e.g. "ERR" suppresses messages and warnings. An
+// empty level disables the threshold (default). The threshold applies in
+// addition to logAll: messages are only logged if logAll is set and the
+// threshold is at most MSG. Warnings (see notifier.Warn), which are logged
+// regardless of logAll, are skipped by a threshold of ERR. Entries of custom
+// levels (see RegisterLevel) are not affected. The threshold can be changed on
+// a running notifier and applies to the notes logged afterwards, including
+// notes that are already waiting in the note channel.
+func (no *Notifier) SetMinLevel(level string) error {
+	if _, ranked := levelSeverity[level]; !ranked && level != "" {
+		return newf(4, 1, "Unknown level '%s': expected MSG, WRN or ERR", level)
+	}
+
+	no.verbosity.Lock()
+	no.verbosity.minLevel = level
+	no.verbosity.Unlock()
+	return nil
+}
+
+// ErrorCount returns the number of entries of level ERR logged during the
+// lifetime of the notifier, e.g. to set the exit code of a command line tool
+// after notifier.Exit():
+//
+//	if notifier.ErrorCount() > 0 {
+//		os.Exit(1)
+//	}
+func (no *Notifier) ErrorCount() int {
+	no.stats.Lock()
+	defer no.stats.Unlock()
+	return no.stats.Errors
+}
+
+// HighestLevelSeen returns the most severe of the levels MSG, WRN and ERR
+// among the entries logged during the lifetime of the notifier (empty if none
+// was logged). Custom levels (see RegisterLevel) are not ranked.
+func (no *Notifier) HighestLevelSeen() string {
+	no.stats.Lock()
+	defer no.stats.Unlock()
+	return no.stats.highest
+}
+
+// SetMaxCode raises the upper bound (exclusive) of the codes replaceable by
+// notifier.SetCodes (default: 999), e.g. to register codes of an internal error
+// registry in the thousands. Codes 998 (internal warnings) and 999 ("should
+// never happen" cases) stay reserved. The bound cannot be changed after
+// executing notifier.Run().
+func (no *Notifier) SetMaxCode(max int) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the maximum code on a running notifier")
+	}
+	if max < 999 {
+		return newf(4, 1, "The maximum code cannot be lower than 999, got %d", max)
+	}
+	no.maxCode = max
+	return nil
+}
+
+// SetCodes replaces built-in notification codes with custom ones.
+// A partial replacement (e.g. codes 2-10) is also allowed, however only calls
+// to notifier.SetCodes of a non-active notifier are allowed. After executing
+// notifier.Run() a change of codes is not permited anymore.
+// Codes 1 < code < 998 are replaceable by default (see notifier.SetMaxCode).
+func (no *Notifier) SetCodes(newCodes map[int][2]string) error {
+
+	// Sanity check (will panic)
+	no.isOK()
+
+	if no.isReady() {
+		return newf(4, 1, "Cannot change codes on a running notifier")
+	}
+
+	// Queued notes will be logged with the new codes
+	if backlog := no.Backlog(); backlog > 0 {
+		no.warn(fmt.Sprintf("Changing codes of %s while %d notes are queued. They will be logged with the new codes", no.id(), backlog))
+	}
+
+	return no.replaceCodes(no.notificationCodes, newCodes)
+}
+
+// replaceCodes validates new notification codes and writes the valid ones to
+// a code table (see notifier.SetCodes)
+func (no *Notifier) replaceCodes(table map[int][2]string, newCodes map[int][2]string) error {
+	badRange := []int{}
+	badTuple := []int{}
+	for code, notification := range newCodes {
+		if code <= 1 || code >= no.maxCode || code == 998 || code == 999 {
+			no.noteToSelf(newf(4, 1, "Only notification codes 1 < code < %d are replaceable (998 and 999 are reserved). Removing '%d'", no.maxCode, code))
+			delete(newCodes, code)
+			badRange = append(badRange, code)
+		} else if !isLevel(notification[0]) || strings.TrimSpace(notification[1]) == "" {
+			no.noteToSelf(newf(4, 1, "Code %d has an unknown level '%s' or an empty status. Removing '%d'", code, notification[0], code))
+			delete(newCodes, code)
+			badTuple = append(badTuple, code)
+		} else {
+			table[code] = notification
+		}
+	}
+
+	if len(badRange)+len(badTuple) == 0 {
+		return nil
+	}
+
+	problems := []string{}
+	if len(badRange) > 0 {
+		problems = append(problems, "invalid range (codes "+joinCodes(badRange)+")")
+	}
+	if len(badTuple) > 0 {
+		problems = append(problems, "unknown level or empty status (codes "+joinCodes(badTuple)+")")
+	}
+	return newf(4, 1, "Failed replacing %d status codes: %s", len(badRange)+len(badTuple), strings.Join(problems, "; "))
+}
+
+// ResetCodes restores the built-in notification codes, discarding all custom
+// codes. Like notifier.SetCodes, codes cannot be reset after executing
+// notifier.Run().
+func (no *Notifier) ResetCodes() error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot reset codes on a running notifier")
+	}
+	no.notificationCodes = copyCodes(standardCodes)
+	return nil
+}
+
+// LoadCodes reads notification codes from a JSON file and applies them like
+// notifier.SetCodes, e.g.:
+//
+//	{"404": {"level": "ERR", "status": "NotFound"}, "42": {"level": "MSG", "status": "Answer"}}
+//
+// Calling LoadCodes again reloads the file, also on a running notifier: the
+// loaded codes replace the code table at once, so entries are logged either
+// with the previous codes or with the reloaded ones. Codes that are not in the
+// file are kept.
+func (no *Notifier) LoadCodes(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return newf(3, 1, "Failed reading codes from %s: %s", path, err.Error())
+	}
+
+	var codes map[string]struct {
+		Level  string `json:"level"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(data, &codes); err != nil {
+		return newf(2, 1, "Failed parsing codes from %s: %s", path, err.Error())
+	}
+
+	newCodes := make(map[int][2]string, len(codes))
+	for key, c := range codes {
+		code, err := strconv.Atoi(strings.TrimSpace(key))
+		if err != nil {
+			return newf(2, 1, "Failed parsing codes from %s: '%s' is not a code", path, key)
+		}
+		newCodes[code] = [2]string{c.Level, c.Status}
+	}
+
+	if !no.isReady() {
+		return no.SetCodes(newCodes)
+	}
+
+	// Running notifiers switch to a copy of the code table
+	table := copyCodes(no.codes())
+	err = no.replaceCodes(table, newCodes)
+	no.codesLock.Lock()
+	no.notificationCodes = table
+	no.codesLock.Unlock()
+	return err
+}
+
+// DeleteCode removes a notification code. The system codes 0, 1, 998 and 999
+// cannot be removed. Like notifier.SetCodes, codes cannot be removed after executing
+// notifier.Run().
+func (no *Notifier) DeleteCode(code int) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot delete codes on a running notifier")
+	}
+
+	switch code {
+	case 0, 1, 998, 999:
+		return newf(4, 1, "Cannot delete the system code %d", code)
+	}
+
+	if _, ok := no.notificationCodes[code]; !ok {
+		return newf(4, 1, "Cannot delete the unknown code %d", code)
+	}
+	delete(no.notificationCodes, code)
+	return nil
+}
+
+// IsLevel checks whether the provided error resolves to the level %level%
+// (e.g. ERR) in the notifier's code table. Like notify.IsCode, errors that are
+// not notify.notification are treated as if having code=1.
+func (no *Notifier) IsLevel(level string, err error) bool {
+	return err != nil && no.codes()[no.codeOf(err)][0] == level
+}
+
+// IsStatus checks whether the provided error resolves to the status %status%
+// (e.g. HTTP-StatusNotFound) in the notifier's code table. Like
+// notify.IsCode, errors that are not notify.notification are treated as if
+// having code=1.
+func (no *Notifier) IsStatus(status string, err error) bool {
+	return err != nil && no.codes()[no.codeOf(err)][1] == status
+}
+
+// SetCodeRemap rewrites notification codes before they are logged, e.g.
+// map[int]int{3: 10} logs all code-3 notifications of any sender as code 10.
+// The original code is logged as OrigCode (appended as orig_code=3 in text
+// mode). Messages (code 0) and internal codes (998, 999) cannot be remapped
+// and all targets must be known codes. Unlike codes, the remapping can be
+// changed on a running notifier, e.g. to contain an incident. A nil map
+// removes the remapping.
+func (no *Notifier) SetCodeRemap(codeRemap map[int]int) error {
+
+	bad := []int{}
+	remapped := make(map[int]int, len(codeRemap))
+	for from, to := range codeRemap {
+		if _, known := no.codes()[to]; !known || from == 0 || from == 998 || from == 999 {
+			bad = append(bad, from)
+			continue
+		}
+		remapped[from] = to
+	}
+	if len(bad) > 0 {
+		return newf(4, 1, "Cannot remap codes %s: messages and internal codes cannot be remapped and targets must be known", joinCodes(bad))
+	}
+
+	no.remap.Lock()
+	no.remap.codes = remapped
+	no.remap.Unlock()
+	return nil
+}
+
+// SetTemplates sets message templates for notification codes. A template is a
+// format string with a single verb (e.g. "resource %s not found"), which is
+// replaced by the formatted message of a fail function. Like notifier.SetCodes,
+// templates cannot be changed after executing notifier.Run().
+func (no *Notifier) SetTemplates(templates map[int]string) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change templates on a running notifier")
+	}
+
+	no.templates = make(map[int]string, len(templates))
+	for code, template := range templates {
+		no.templates[code] = template
+	}
+	return nil
+}
+
+// SetDigest replaces individual entries of a notification code with a digest,
+// which is logged once per interval (e.g. "Code 3 occurred 250 times in the
+// last 1m0s (latest: ...)"). Pending digests are logged at exit. Like
+// notifier.SetCodes, digests cannot be changed after executing notifier.Run().
+func (no *Notifier) SetDigest(code int, interval time.Duration) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change digests on a running notifier")
+	}
+	if interval <= 0 {
+		return newf(4, 1, "Digest interval must be positive")
+	}
+
+	if no.digests == nil {
+		no.digests = make(map[int]*digest)
+	}
+	no.digests[code] = &digest{interval: interval}
+	return nil
+}
+
+// SetFirstAlwaysSampling samples entries of a notification code: the first
+// occurrence is always logged, subsequent occurrences within the window are
+// logged at the given rate (e.g. 0.1 logs every tenth entry). Once the window
+// has passed, the next occurrence is logged as a first occurrence again.
+// Dropped entries are counted (see notifier.Stats). Like notifier.SetCodes,
+// sampling cannot be changed after executing notifier.Run().
+func (no *Notifier) SetFirstAlwaysSampling(code int, rate float64, window time.Duration) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change sampling on a running notifier")
+	}
+	if rate < 0 || rate > 1 {
+		return newf(4, 1, "Sampling rate must be between 0 and 1, got %g", rate)
+	}
+	if window <= 0 {
+		return newf(4, 1, "Sampling window must be positive")
+	}
+
+	if no.samplers == nil {
+		no.samplers = make(map[int]*sampler)
+	}
+	no.samplers[code] = &sampler{rate: rate, window: window}
+	return nil
+}
+
+// Run logs messages sent to the note channel
+// Run is the only consumer of the note channel as well as the logging facility
+// Run returns once notifier.Exit() has logged the backlog and closed the endpoints
+func (no *Notifier) Run() {
+
+	if no.noop {
+		return
+	}
+
+	// Sanity check
+	no.isOK()
+
+	// Start new log files with a header line
+	no.endpoints.Lock()
+	for i, endpoint := range no.endpoints.endpointsPtr {
+		if path := no.endpoints.files[i]; path != "" {
+			no.writeHeader(endpoint, path)
+		}
+		no.openArray(i)
+	}
+	no.array.started = no.array.enabled
+	no.endpoints.Unlock()
+
+	// Enable operations
+	no.ops.Lock()
+	no.ops.halt = false
+	no.ops.running = true
+	if no.exitSummary {
+		no.started = no.now() // the clock is only consulted for summaries
+	}
+	select {
+	case <-no.ready:
+	default:
+		close(no.ready) // Release notifier.WarmUp()
+	}
+	no.ops.Unlock()
+
+	// Check the rotation schedule every second
+	var rotationTick <-chan time.Time
+	if no.rotation != nil {
+		no.nextRotation = no.rotation.next(no.now())
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		rotationTick = ticker.C
+	}
+
+	// Flush buffered log files periodically
+	var fileTick <-chan time.Time
+	if no.fileBuffer > 0 {
+		ticker := time.NewTicker(no.fileFlushInterval)
+		defer ticker.Stop()
+		fileTick = ticker.C
+	}
+
+	// Write batched entries at least once per interval
+	var batchTick <-chan time.Time
+	if no.batchSize > 0 {
+		ticker := time.NewTicker(no.batchInterval)
+		defer ticker.Stop()
+		batchTick = ticker.C
+	}
+
+	// Check digests periodically
+	var digestTick <-chan time.Time
+	if len(no.digests) > 0 {
+		ticker := time.NewTicker(no.digestPeriod())
+		defer ticker.Stop()
+		digestTick = ticker.C
+	}
+
+	// Receive notes until the last note of notifier.Exit() has been logged.
+	// The note channel is never closed, so that senders cannot panic.
+	var n *note
+
+runLoop:
+	for {
+
+		// Notes left in replaced channels precede those of the current channel
+		var noteChan chan *note
+		if n, noteChan = no.retiredNote(); n == nil {
+			select {
+			case n = <-noteChan:
+			case <-no.resized:
+				continue // receive from the new channel
+			case <-batchTick:
+				no.endpoints.Lock()
+				no.flushBatch()
+				no.endpoints.Unlock()
+				continue
+			case <-fileTick:
+				no.endpoints.Lock()
+				no.flushFiles()
+				no.endpoints.Unlock()
+				continue
+			case <-rotationTick:
+				no.rotateIfDue()
+				continue
+			case <-digestTick:
+				no.flushDigests(false)
+				continue
+			}
+		}
+
+		// Hold the note while the notifier is paused
+		if resume := no.paused(); resume != nil {
+			<-resume
+		}
+
+		// The exit grace period has expired
+		select {
+		case <-no.abort:
+			no.dump(n)
+			if n.Last {
+				break runLoop
+			}
+			continue
+		default:
+		}
+
+		// Digests are written before the last note
+		if n.Last {
+			no.flushDigests(true)
+			if no.exitSummary {
+				n.Fields = no.summary()
+				n.Summary = true
+			}
+		}
+
+		// Write to endpoints
+		no.lockedLog(n)
+		if n.Last {
+			break runLoop
+		}
+
+	}
+
+	<-no.done
+}
+
+// Pause temporarily stops writing to endpoints. Notes are still accepted and
+// stay in the note channel until notifier.Resume() is called, in which case
+// they are logged in their original order. Once the note channel is full,
+// synchronous send and fail functions block until the notifier is resumed,
+// while asynchronous ones block once the queue of the async workers is full
+// too (see notifier.SetAsyncWorkers).
+func (no *Notifier) Pause() {
+	no.pause.Lock()
+	if no.pause.resume == nil {
+		no.pause.resume = make(chan struct{})
+	}
+	no.pause.Unlock()
+}
+
+// Resume resumes writing to endpoints after notifier.Pause()
+func (no *Notifier) Resume() {
+	no.pause.Lock()
+	if no.pause.resume != nil {
+		close(no.pause.resume)
+		no.pause.resume = nil
+	}
+	no.pause.Unlock()
+}
+
+// AddEndpoint adds an endpoint (a file path or an io.Writer) to the
+// notifier. Endpoints can be added while the notifier is running.
+func (no *Notifier) AddEndpoint(endpoint interface{}) error {
+	no.endpoints.Lock()
+	defer no.endpoints.Unlock()
+
+	if err := no.attach(endpoint); err != nil {
+		return newf(4, 1, "Cannot add endpoint: %s", err.Error())
+	}
+	return nil
+}
+
+// RemoveEndpoint removes an endpoint (a file path or an io.Writer) from the
+// notifier. Log files opened by the notifier are closed and can be used by
+// other notifiers again. Writers are identified by pointer (e.g. *os.File or
+// *bytes.Buffer); writers passed by value cannot be removed.
+func (no *Notifier) RemoveEndpoint(endpoint interface{}) error {
+	no.endpoints.Lock()
+	defer no.endpoints.Unlock()
+
+	// Batched entries belong to all current endpoints
+	no.flushBatch()
+
+	for i, f := range no.endpoints.endpointsPtr {
+
+		path := no.endpoints.files[i]
+		switch e := endpoint.(type) {
+		case string:
+			if path == "" || path != e {
+				continue
+			}
+		case io.Writer:
+			if !sameWriter(f, e) {
+				continue
+			}
+		default:
+			return newf(4, 1, "Cannot remove endpoint: unsupported type %T", endpoint)
+		}
+
+		no.closeArray(i)
+		no.endpoints.remove(i)
+		if path != "" {
+			f.(io.Closer).Close()
+			releaseFileEndpoint(path)
+		}
+		return nil
+	}
+
+	return newf(4, 1, "Cannot remove endpoint: %v is not an endpoint of %s", endpoint, no.id())
+}
+
+// SetWriteBatching buffers formatted entries and writes them to each endpoint
+// with a single write, once the batch holds the given number of entries or
+// once the interval has passed, whichever comes first. This reduces the number
+// of system calls under load. Batched entries are written at exit, but are
+// lost if the process crashes (or is killed) before they are written. Senders
+// (including SendSync) do not wait for batched entries to be written. Entries
+// <= 0 disables batching. Batching cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetWriteBatching(entries int, interval time.Duration) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change write batching on a running notifier")
+	}
+	if entries > 0 && interval <= 0 {
+		return newf(4, 1, "Batching interval must be positive")
+	}
+
+	no.batchSize = entries
+	no.batchInterval = interval
+	return nil
+}
+
+// SetAsyncWorkers sets the number of goroutines that route the notes of
+// asynchronous send and fail functions to the note channel (default: 4). The
+// notes wait for a worker in a queue with the capacity of the note channel, so
+// asynchronous sends block only once both are full. With more than one worker,
+// notes sent sequentially can be logged in reversed order. The workers are
+// started by the first asynchronous send and stopped by notifier.Exit(), so
+// their number cannot be changed afterwards. The number is ignored in ordered
+// mode (see notifier.SetOrderedAsync).
+func (no *Notifier) SetAsyncWorkers(workers int) error {
+	if workers < 1 {
+		return newf(4, 1, "The number of async workers must be positive")
+	}
+
+	no.pool.Lock()
+	defer no.pool.Unlock()
+
+	if no.pool.queue != nil {
+		return newf(4, 1, "Cannot change the number of async workers after the first asynchronous send")
+	}
+	no.pool.workers = workers
+	return nil
+}
+
+// SetOrderedAsync routes the notes of asynchronous send and fail functions
+// through a single worker, so that they are logged in the order in which they
+// were sent (e.g. for audit logs). Senders still do not wait for the notifier,
+// but a single worker moves notes to the note channel more slowly under
+// contention than several (see notifier.SetAsyncWorkers). The mode cannot be
+// changed after the first asynchronous send.
+func (no *Notifier) SetOrderedAsync(ordered bool) error {
+	no.pool.Lock()
+	defer no.pool.Unlock()
+
+	if no.pool.queue != nil {
+		return newf(4, 1, "Cannot change the ordering of asynchronous sends after the first asynchronous send")
+	}
+	no.pool.ordered = ordered
+	return nil
+}
+
+// SetFileBuffering sets the buffer size of the log files opened by the
+// notifier (default: 4096 bytes) and the interval at which buffered entries
+// are written to the files (default: one second). Buffered entries are also
+// written by synchronous sends (e.g. notifier.SendSync), notifier.Flush,
+// notifier.FlushEndpoint, notifier.Reopen, at rotation and at exit, but are
+// lost if the process crashes (or is killed) before they are written. Failures
+// of buffered writes are detected late, so the affected entries are not sent
+// to the fallback endpoint. Other endpoints (e.g. os.Stdout) are not buffered.
+// Size <= 0 disables buffering. Buffering cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetFileBuffering(size int, interval time.Duration) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change file buffering on a running notifier")
+	}
+	if size > 0 && interval <= 0 {
+		return newf(4, 1, "Flush interval must be positive")
+	}
+
+	no.endpoints.Lock()
+	defer no.endpoints.Unlock()
+
+	no.fileBuffer = size
+	no.fileFlushInterval = interval
+
+	// Rebuffer the files opened at instantiation
+	for i, endpoint := range no.endpoints.endpointsPtr {
+		path := no.endpoints.files[i]
+		if path == "" {
+			continue
+		}
+
+		f := endpoint
+		if bf, ok := endpoint.(*bufferedFile); ok {
+			if err := bf.Flush(); err != nil {
+				syswarn("failed flushing " + path + ": " + err.Error())
+			}
+			f = bf.file
+		}
+
+		w := no.bufferFile(f.(*os.File))
+		no.endpoints.endpointsPtr[i] = w
+	}
+	return nil
+}
+
+// SetRotationSchedule rotates the log files opened by the notifier according to
+// a minimal cron spec ("minute hour day-of-month month day-of-week", e.g.
+// "0 * * * *") or one of the shortcuts @hourly, @daily, @midnight, @weekly and
+// @monthly. A rotated file is renamed to <file>.<time of rotation>
+// (e.g. service.log.20170101-130000) and a new file is opened. An empty spec
+// disables rotation. The schedule cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetRotationSchedule(spec string) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the rotation schedule on a running notifier")
+	}
+
+	if spec == "" {
+		no.rotation = nil
+		return nil
+	}
+
+	rotation, err := parseSchedule(spec)
+	if err != nil {
+		return newf(4, 1, "Invalid rotation schedule: %s", err.Error())
+	}
+	if rotation.next(no.now()).IsZero() {
+		return newf(4, 1, "Rotation schedule '%s' never occurs", spec)
+	}
+	no.rotation = rotation
+	return nil
+}
+
+// SetCompressRotated gzips log files rotated by the notifier (see
+// notifier.SetRotationSchedule) to <rotated file>.gz in the background and
+// keeps only the newest compressed backups of each log file (keep <= 0: all
+// backups). Only log files opened by the notifier are rotated, so other
+// endpoints (e.g. os.Stdout) are never compressed. notifier.Exit() waits for
+// running compressions. Compression cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetCompressRotated(compress bool, keep int) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change compression of rotated files on a running notifier")
+	}
+
+	no.compressRotated = compress
+	no.keepCompressed = keep
+	return nil
+}
+
+// SetFileHeader sets whether empty log files opened by the notifier start with
+// a header line, so that parsers can configure themselves. The header is a
+// JSON object describing the format, the service, the instance and the fields
+// of the entries, e.g.:
+//
+//	{"Header":"fractal-notify","Version":1,"Format":"text","Service":"MyService",...}
+//
+// It is written when the notifier starts and whenever a log file is created
+// later on (e.g. by a rotation, notifier.Reopen or notifier.AddEndpoint). Files
+// that already contain entries when they are opened are appended to without a
+// header, and other endpoints (e.g. os.Stdout) never get one. LogReader skips
+// header lines. The header cannot be changed after executing notifier.Run().
+func (no *Notifier) SetFileHeader(header bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the file header on a running notifier")
+	}
+
+	no.fileHeader = header
+	return nil
+}
+
+// Reopen reopens the log files opened by the notifier, e.g. after they have
+// been moved by logrotate. A log file that cannot be reopened (e.g. because
+// its directory is not writable) is not replaced: the notifier keeps writing
+// to the previous file and logs a failure (code 3).
+func (no *Notifier) Reopen() error {
+
+	failed := []string{}
+
+	no.endpoints.Lock()
+	no.flushBatch()
+	for i, path := range no.endpoints.files {
+		if path != "" {
+			if err := no.reopenFile(i); err != nil {
+				failed = append(failed, err.Error())
+			}
+		}
+	}
+	no.endpoints.Unlock()
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	// Notes must not be sent while holding the endpoints
+	return no.noteToSelf(newf(3, 1, "Failed reopening log files, keeping the previous files: %s", strings.Join(failed, "; ")))
+}
+
+// FlushEndpoint flushes a single endpoint, addressed by its id (see
+// NamedWriter). Endpoints implementing Flush() error (e.g. *bufio.Writer) are
+// flushed and files are synced to disk. Other endpoints are not buffered.
+func (no *Notifier) FlushEndpoint(id string) error {
+	no.endpoints.Lock()
+	defer no.endpoints.Unlock()
+
+	no.flushBatch()
+	for i, endpoint := range no.endpoints.endpointsPtr {
+		if id == "" || no.endpointID(i) != id {
+			continue
+		}
+
+		if err := flushEndpoint(endpoint); err != nil {
+			return newf(3, 1, "Failed flushing endpoint %s: %s", id, err.Error())
+		}
+		return nil
+	}
+
+	return newf(4, 1, "Cannot flush endpoint: %s is not an endpoint of %s", id, no.id())
+}
+
+// Flush writes batched entries and buffered log lines to the endpoints, flushes
+// endpoints implementing Flush() error and syncs files to disk (see
+// notifier.FlushEndpoint). All endpoints are flushed, even if some fail.
+func (no *Notifier) Flush() error {
+	no.endpoints.Lock()
+	defer no.endpoints.Unlock()
+
+	no.flushBatch()
+
+	failed := []string{}
+	for i, endpoint := range no.endpoints.endpointsPtr {
+		if err := flushEndpoint(endpoint); err != nil {
+			failed = append(failed, strconv.Itoa(i+1)+"th endpoint: "+err.Error())
+		}
+	}
+
+	if len(failed) > 0 {
+		return newf(3, 1, "Failed flushing endpoints: %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// IsRunning indicates whether notifier.Run() has started and notifier.Exit()
+// has not finished yet, e.g. to avoid the error of exiting a notifier that is
+// not running or to report the state in a health check.
+func (no *Notifier) IsRunning() bool {
+	return no.isReady()
+}
+
+// SetHealthBacklog sets the backlog (number of notes waiting in the note
+// channel) at which notifier.Health reports the notifier as saturated. The
+// default (mark <= 0) is the capacity of the note channel, i.e. a full
+// channel. The mark cannot be changed after executing notifier.Run().
+func (no *Notifier) SetHealthBacklog(mark int) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the health backlog on a running notifier")
+	}
+
+	no.healthBacklog = mark
+	return nil
+}
+
+// Health returns nil if the notifier is running, its backlog is below the
+// high-water mark (see notifier.SetHealthBacklog) and the latest log line was
+// written to all endpoints, including the standard streams written by
+// notifier.SetStdSplit and the flushes of buffered log files. Otherwise an
+// error describes the first problem found. It is meant for readiness and
+// liveness probes, e.g. of Kubernetes. A noop notifier is always healthy.
+func (no *Notifier) Health() error {
+	if no.noop {
+		return nil
+	}
+
+	if !no.IsRunning() {
+		return newf(3, 1, "%s is not running", no.id())
+	}
+	if no.isHalted() {
+		return newf(3, 1, "%s is exiting", no.id())
+	}
+
+	mark := no.healthBacklog
+	if mark <= 0 {
+		mark = no.Capacity()
+	}
+	if backlog := no.Backlog(); mark > 0 && backlog >= mark {
+		return newf(3, 1, "%s is saturated: %d notes waiting (high-water mark: %d)", no.id(), backlog, mark)
+	}
+
+	no.stats.Lock()
+	failed, failures := no.stats.lastFailed, no.stats.WriteFailures
+	no.stats.Unlock()
+	if failed {
+		return newf(3, 1, "%s failed writing the latest log line (%d failed writes in total)", no.id(), failures)
+	}
+
+	return nil
+}
+
+// Ready returns a channel that is closed once notifier.Run() has taken over
+// the consumption of notes. Unlike notifier.WarmUp, it can be combined with
+// other channels in a select statement.
+func (no *Notifier) Ready() <-chan struct{} {
+	return no.ready
+}
+
+// WarmUp waits until the notifier is ready.
+// This function is relevant only when notifier.Run() is started as a goroutine.
+func (no *Notifier) WarmUp() {
+	<-no.ready
+}
+
+// WarmUpTimeout waits until the notifier is ready like notifier.WarmUp, but
+// gives up after the timeout, e.g. if notifier.Run() is never started.
+func (no *Notifier) WarmUpTimeout(timeout time.Duration) error {
+	select {
+	case <-no.ready:
+		return nil
+	case <-time.After(timeout):
+		return newf(3, 1, "%s did not start within %s", no.id(), timeout)
+	}
+}
+
+// ExitAsync exits the notifier (see notifier.Exit) in a goroutine and returns
+// immediately. The returned channel receives the error of notifier.Exit once
+// the backlog has been logged and the endpoints are closed. It can be ignored
+// or used to wait for a limited time. Notes sent after ExitAsync returns may
+// still be logged until the notifier halts.
+func (no *Notifier) ExitAsync() <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- no.Exit()
+	}()
+	return done
+}
+
+// Exit halts the notifier and waits for it to finish logging the backlog,
+// including the notes sent asynchronously before Exit was called.
+// If an exit grace period is set (see SetExitGrace), the backlog remaining
+// after the grace period is dumped to the fallback endpoint (os.Stderr if none).
+// Exit is idempotent: only the first call stops the notifier and closes the
+// endpoints, later and concurrent calls return an error.
+func (no *Notifier) Exit() error {
+
+	if no.noop {
+		return nil
+	}
+
+	// Only one caller may stop the notifier
+	no.exitLock.Lock()
+	defer no.exitLock.Unlock()
+	if no.exited {
+		return errors.New(no.id() + " has already exited.")
+	}
+	no.exited = true
+
+	var err error
+
+	running := true
+	if !no.isReady() {
+		running = false
+		err = errors.New(no.id() + " was not running at exit time.")
+	}
+
+	// A paused notifier cannot process the last log entry
+	no.Resume()
+
+	// Halt operations and issue last log entry
+	if running {
+
+		// Dump the backlog to the fallback endpoint once the grace period expires
+		var expired <-chan time.Time
+		if grace := exitGracePeriod(); grace > 0 {
+			expired = time.After(grace)
+		}
+
+		// Notes sent asynchronously before exiting are part of the backlog
+		if !no.drainPool(expired) {
+			close(no.abort)
+			no.drainPool(nil) // the remaining notes are dumped
+		}
+
+		no.ops.Lock()
+		no.ops.halt = true
+		confirm := make(chan bool, 1)
+		last := &note{Sender: "notifier", Value: "Exit() command has been executed. Stopping the notification service.", Confirm: confirm, Last: true}
+
+		select {
+		case no.noteChan <- last:
+			no.ops.Unlock()
+			select {
+			case <-confirm:
+			case <-expired:
+				close(no.abort)
+				<-confirm
+			}
+		case <-expired:
+			close(no.abort)
+			no.noteChan <- last
+			no.ops.Unlock()
+			<-confirm
+		}
+
+		close(confirm)
+	} else {
+		no.ops.Lock()
+		no.ops.halt = true
+		no.ops.Unlock()
+	}
+
+	// Allow other notifiers to use service and instance names
+	if no.registered {
+		deregisterInstance(no.service, no.instance)
+		no.registered = false
+	}
+
+	// Close endpoints and release log files
+	no.endpoints.Lock()
+	no.array.started = false
+	for i, endpoint := range no.endpoints.endpointsPtr {
+		no.closeArray(i)
+		if c, ok := endpoint.(io.Closer); ok && endpoint != os.Stdout && endpoint != os.Stderr {
+			c.Close()
+		}
+		if path := no.endpoints.files[i]; path != "" {
+			releaseFileEndpoint(path)
+			no.endpoints.files[i] = ""
+		}
+	}
+	no.endpoints.Unlock()
+
+	// Finish compressing rotated log files
+	no.compressions.Wait()
+
+	// Set status
+	no.ops.Lock()
+	no.ops.running = false
+	no.ops.Unlock()
+
+	close(no.done) // Release notifier.Run()
 
 	return err
 }
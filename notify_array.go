@@ -0,0 +1,105 @@
+package notify
+
+import (
+	"io"
+	"strings"
+)
+
+// jsonArray is the JSON array mode of a notifier (see notifier.SetJSONArray).
+// The arrays of the endpoints are tracked by the endpoints (see
+// endpoints.arrays). It is guarded by the endpoints lock.
+type jsonArray struct {
+	enabled bool
+	started bool // Set while notifier.Run() writes to the endpoints (arrays of new endpoints are opened)
+}
+
+// SetJSONArray makes the notifier write a single JSON array to each endpoint
+// instead of one JSON object per line (JSONL), so that a log file is a
+// well-formed JSON document as a whole:
+//
+//	[
+//	{"Timestamp":1481552048,"Service":"MyService",...},
+//	{"Timestamp":1481552049,"Service":"MyService",...}
+//	]
+//
+// notifier.Run() opens the arrays, entries are separated by commas and
+// notifier.Exit() closes the arrays ("[]" if there were no entries). Endpoints
+// added at runtime get an array of their own, which notifier.RemoveEndpoint
+// closes. Reopening or rotating a log file closes the array of the previous
+// file and opens a new one. Use it with new files: an array appended to a
+// non-empty file does not form a valid document. Unlike JSONL, the log is not
+// valid JSON if the process crashes before notifier.Exit() closes the arrays.
+// File headers (see notifier.SetFileHeader) are not written and the standard
+// streams written by notifier.SetStdSplit (including os.Stdout and os.Stderr
+// endpoints skipped by StdSplitInstead) get JSON lines. The mode requires the
+// JSON format (see NewNotifier) and cannot be changed after executing
+// notifier.Run().
+func (no *Notifier) SetJSONArray(array bool) error {
+	if no.isReady() {
+		return newf(4, 1, "Cannot change the JSON array mode on a running notifier")
+	}
+	if array && (!no.json || no.formatter != nil) {
+		return newf(4, 1, "JSON arrays require the JSON format of %s", no.id())
+	}
+
+	no.array.enabled = array
+	return nil
+}
+
+// openArray starts the JSON array of the i-th endpoint, unless it is open
+// already. The endpoints have to be locked by the caller.
+func (no *Notifier) openArray(i int) {
+	if !no.array.enabled || no.endpoints.arrays[i] >= 0 || no.splitOff(no.endpoints.endpointsPtr[i]) {
+		return // standard streams written by notifier.writeStd get no array
+	}
+
+	no.endpoints.arrays[i] = 0
+	no.writeArray(no.endpoints.endpointsPtr[i], "[")
+}
+
+// arrayEntries turns formatted entries (one JSON object per line) into
+// elements of the JSON array of the i-th endpoint. The endpoints have to be
+// locked by the caller.
+func (no *Notifier) arrayEntries(i int, str string) string {
+	if !no.array.enabled {
+		return str
+	}
+
+	prefix := ",\n"
+	count := no.endpoints.arrays[i]
+	switch {
+	case count < 0:
+		prefix = "[\n" // endpoint added while notifier.Run() was starting
+		count = 0
+	case count == 0:
+		prefix = "\n"
+	}
+
+	// JSON objects do not contain raw line breaks
+	lines := strings.TrimSuffix(str, "\n")
+	no.endpoints.arrays[i] = count + strings.Count(lines, "\n") + 1
+	return prefix + strings.Replace(lines, "\n", ",\n", -1)
+}
+
+// closeArray ends the JSON array of the i-th endpoint, if it is open. The
+// endpoints have to be locked by the caller.
+func (no *Notifier) closeArray(i int) {
+	count := no.endpoints.arrays[i]
+	if count < 0 {
+		return
+	}
+
+	no.endpoints.arrays[i] = -1
+	if count > 0 {
+		no.writeArray(no.endpoints.endpointsPtr[i], "\n]\n")
+	} else {
+		no.writeArray(no.endpoints.endpointsPtr[i], "]\n")
+	}
+}
+
+// writeArray writes the delimiters of a JSON array to an endpoint
+func (no *Notifier) writeArray(w io.Writer, delimiter string) {
+	if _, err := io.WriteString(w, delimiter); err != nil {
+		syswarn("failed writing the JSON array delimiter '" + strings.TrimSpace(delimiter) + "': " + err.Error()) // do not log to avoid infinite loop
+	}
+}
@@ -0,0 +1,132 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONArray(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestJSONArray.log"
+	defer os.Remove(logfile)
+
+	text := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+	if err := text.SetJSONArray(true); err == nil {
+		t.Error("JSON arrays should require the JSON format")
+	}
+
+	var empty, added bytes.Buffer
+	lines := []string{}
+	value := valueWriter{lines: &lines, tags: []string{"uncomparable"}}
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile, &empty, value)
+	if err := notifier.SetJSONArray(true); err != nil {
+		t.Fatal("Failed setting the JSON array mode: " + err.Error())
+	}
+	if err := notifier.SetCSVFormat(); err == nil {
+		t.Error("Formatters should be rejected in the JSON array mode")
+	}
+	notifier.SetFileHeader(true)
+	notifier.SetWriteBatching(2, time.Hour)
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetJSONArray(false); err == nil {
+		t.Error("The JSON array mode should not change on a running notifier")
+	}
+
+	notifier.RemoveEndpoint(&empty)
+	notifier.AddEndpoint(&added)
+	for _, message := range []string{"first", "second", "third"} {
+		notifier.SendSync("TestJSONArray", message)
+	}
+	notifier.Exit()
+
+	// Each endpoint holds a well-formed array
+	content, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatal("Failed reading the log file: " + err.Error())
+	}
+	for name, doc := range map[string][]byte{"file": content, "added": added.Bytes(), "value": []byte(strings.Join(lines, ""))} {
+		entries := []LogEntry{}
+		if err := json.Unmarshal(doc, &entries); err != nil {
+			t.Errorf("Expected a JSON array in the %s endpoint: %s\n%s", name, err.Error(), doc)
+			continue
+		}
+		if len(entries) != 4 || entries[0].Message != "first" || entries[2].Message != "third" {
+			t.Errorf("Unexpected entries in the %s endpoint: %v", name, entries)
+		}
+	}
+	if doc := strings.TrimSpace(empty.String()); doc != "[]" {
+		t.Errorf("Expected an empty array in the removed endpoint, got '%s'", doc)
+	}
+
+	// The log reader unwraps arrays
+	reader := NewLogReader(bytes.NewReader(content))
+	count := 0
+	for {
+		if _, err := reader.Next(); err != nil {
+			break
+		}
+		count++
+	}
+	if count != 4 {
+		t.Errorf("Expected 4 entries read from the array, got %d", count)
+	}
+}
+
+func TestJSONArrayStreams(t *testing.T) {
+
+	stdoutfile := os.Getenv("HOME") + "/TestJSONArrayStreams.stdout"
+	fallbackfile := os.Getenv("HOME") + "/TestJSONArrayStreams.fallback"
+	defer os.Remove(stdoutfile)
+	defer os.Remove(fallbackfile)
+
+	stdout, err := os.Create(stdoutfile)
+	if err != nil {
+		t.Fatal("Failed creating the stdout file: " + err.Error())
+	}
+	fallback, err := os.Create(fallbackfile)
+	if err != nil {
+		t.Fatal("Failed creating the fallback file: " + err.Error())
+	}
+	defer fallback.Close()
+	old := os.Stdout
+	os.Stdout = stdout
+	defer func() { os.Stdout = old }()
+
+	// A closed file cannot be written to
+	broken, _ := os.Open(os.DevNull)
+	broken.Close()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, os.Stdout, broken)
+	notifier.SetJSONArray(true)
+	notifier.SetStdSplit(StdSplitInstead)
+	notifier.SetFallback(fallback)
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.SendSync("TestJSONArrayStreams", "first")
+	notifier.SendSync("TestJSONArrayStreams", "second")
+	notifier.Exit()
+	os.Stdout = old
+	stdout.Close()
+
+	// The standard output and the fallback get JSON lines
+	for name, file := range map[string]string{"stdout": stdoutfile, "fallback": fallbackfile} {
+		lines := readLogLines(t, file)
+		if len(lines) < 2 {
+			t.Errorf("Expected entries in the %s, got %v", name, lines)
+		}
+		for _, line := range lines {
+			var entry LogEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Errorf("Expected JSON lines in the %s, got '%s'", name, line)
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package notify
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCEFFormatter(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestCEFFormatter.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if err := notifier.SetCEFInfo("Halcyon|Flux", "fractal", "1.0"); err != nil {
+		t.Fatal("Failed setting CEF info: " + err.Error())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Failure("TestCEFFormatter")(404, "Page a=b not found")
+	notifier.Exit()
+
+	line := readLogLines(t, logfile)[0]
+	expected := "CEF:0|Halcyon\\|Flux|fractal|1.0|404|HTTP-StatusNotFound|7|rt="
+	if !strings.HasPrefix(line, expected) {
+		t.Fatalf("Unexpected CEF header: '%s'", line)
+	}
+
+	extensions := strings.SplitN(line[len(expected):], " ", 2)
+	if _, err := strconv.ParseInt(extensions[0], 10, 64); err != nil {
+		t.Errorf("Receipt time is not a number: '%s'", extensions[0])
+	}
+	if !strings.HasPrefix(extensions[1], "msg=Page a\\=b not found") || !strings.HasSuffix(extensions[1], "sender=TestCEFFormatter service=MyService instance=MyServiceInstance") {
+		t.Errorf("Unexpected CEF extensions: '%s'", extensions[1])
+	}
+}
@@ -0,0 +1,190 @@
+package notify
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"time"
+)
+
+// CloudWatch Logs limits for a single PutLogEvents request and a log stream
+const (
+	cloudWatchMaxBatchEvents = 10000                  // Events per request
+	cloudWatchMaxBatchBytes  = 1048576                // Request size, including per-event overhead
+	cloudWatchEventOverhead  = 26                     // Bytes added to the size of each event
+	cloudWatchPutInterval    = 200 * time.Millisecond // At most 5 requests per second and stream
+	cloudWatchFlushInterval  = 5 * time.Second        // Maximum age of a buffered event
+)
+
+// ErrCloudWatchResourceExists should be returned by CloudWatchClient.CreateLogGroup
+// and CloudWatchClient.CreateLogStream when the group or stream already exists
+// (ResourceAlreadyExistsException).
+var ErrCloudWatchResourceExists = errors.New("notify: CloudWatch resource already exists")
+
+// CloudWatchInvalidSequenceTokenError should be returned by
+// CloudWatchClient.PutLogEvents when the sequence token was rejected
+// (InvalidSequenceTokenException). ExpectedSequenceToken is used to retry.
+type CloudWatchInvalidSequenceTokenError struct {
+	ExpectedSequenceToken string
+}
+
+func (e *CloudWatchInvalidSequenceTokenError) Error() string {
+	return "notify: invalid CloudWatch sequence token, expected " + e.ExpectedSequenceToken
+}
+
+// CloudWatchEvent is a single log event sent to CloudWatch Logs.
+type CloudWatchEvent struct {
+	Timestamp int64  // Milliseconds since the epoch
+	Message   string // Log line without the trailing newline
+}
+
+// CloudWatchClient is the subset of the CloudWatch Logs API used by
+// CloudWatchLogs. Wrap the AWS SDK client to implement it.
+type CloudWatchClient interface {
+	CreateLogGroup(group string) error
+	CreateLogStream(group, stream string) error
+	PutLogEvents(group, stream string, events []CloudWatchEvent, sequenceToken string) (nextSequenceToken string, err error)
+}
+
+// CloudWatchLogs is an endpoint writing log lines to a CloudWatch Logs stream.
+// Lines are batched and sent at most every 200ms (5 requests per second), at
+// the latest after 5 seconds. The log group and stream are created if absent.
+type CloudWatchLogs struct {
+	sync.Mutex
+	client  CloudWatchClient
+	group   string
+	stream  string
+	token   string              // Sequence token of the next PutLogEvents request
+	ready   bool                // Log group and stream exist
+	batch   []CloudWatchEvent   // Buffered events
+	size    int                 // Size of the buffered events
+	lastPut time.Time           // Time of the latest PutLogEvents request
+	now     func() time.Time    // Clock used for event timestamps
+	sleep   func(time.Duration) // Used to respect the request limit
+	done    chan struct{}
+	closed  bool
+}
+
+// CloudWatchEndpoint returns an endpoint writing log lines to the CloudWatch
+// Logs stream of the given group. It can be passed to NewNotifier or
+// AddEndpoint like any other endpoint. Buffered lines are sent when the
+// notifier exits (or when the endpoint is closed).
+func CloudWatchEndpoint(client CloudWatchClient, group, stream string) *CloudWatchLogs {
+	cw := &CloudWatchLogs{
+		client: client,
+		group:  group,
+		stream: stream,
+		now:    time.Now,
+		sleep:  time.Sleep,
+		done:   make(chan struct{}),
+	}
+	go cw.flushPeriodically()
+	return cw
+}
+
+// Write buffers each line of p as a separate log event. A full batch is sent
+// immediately.
+func (cw *CloudWatchLogs) Write(p []byte) (int, error) {
+	cw.Lock()
+	defer cw.Unlock()
+
+	if cw.closed {
+		return 0, errors.New("CloudWatch endpoint " + cw.group + "/" + cw.stream + " is closed")
+	}
+
+	timestamp := cw.now().UnixNano() / int64(time.Millisecond)
+	for _, line := range bytes.Split(bytes.TrimRight(p, "\n"), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+
+		size := len(line) + cloudWatchEventOverhead
+		if len(cw.batch) == cloudWatchMaxBatchEvents || cw.size+size > cloudWatchMaxBatchBytes {
+			if err := cw.flush(); err != nil {
+				return 0, err
+			}
+		}
+		cw.batch = append(cw.batch, CloudWatchEvent{Timestamp: timestamp, Message: string(line)})
+		cw.size += size
+	}
+
+	return len(p), nil
+}
+
+// Flush sends all buffered events.
+func (cw *CloudWatchLogs) Flush() error {
+	cw.Lock()
+	defer cw.Unlock()
+	return cw.flush()
+}
+
+// Close sends all buffered events and stops the endpoint.
+func (cw *CloudWatchLogs) Close() error {
+	cw.Lock()
+	defer cw.Unlock()
+
+	if cw.closed {
+		return nil
+	}
+	cw.closed = true
+	close(cw.done)
+
+	return cw.flush()
+}
+
+// flushPeriodically sends buffered events until the endpoint is closed
+func (cw *CloudWatchLogs) flushPeriodically() {
+	ticker := time.NewTicker(cloudWatchFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := cw.Flush(); err != nil {
+				syswarn("failed sending log events to CloudWatch: " + err.Error())
+			}
+		case <-cw.done:
+			return
+		}
+	}
+}
+
+// flush sends the buffered events. The endpoint has to be locked by the caller.
+func (cw *CloudWatchLogs) flush() error {
+	if len(cw.batch) == 0 {
+		return nil
+	}
+
+	if !cw.ready {
+		if err := cw.client.CreateLogGroup(cw.group); err != nil && err != ErrCloudWatchResourceExists {
+			return err
+		}
+		if err := cw.client.CreateLogStream(cw.group, cw.stream); err != nil && err != ErrCloudWatchResourceExists {
+			return err
+		}
+		cw.ready = true
+	}
+
+	// Respect the request limit of the stream and refresh a rejected sequence
+	// token once
+	for retried := false; ; retried = true {
+		if wait := cloudWatchPutInterval - cw.now().Sub(cw.lastPut); wait > 0 {
+			cw.sleep(wait)
+		}
+		cw.lastPut = cw.now()
+
+		token, err := cw.client.PutLogEvents(cw.group, cw.stream, cw.batch, cw.token)
+		if tokenErr, ok := err.(*CloudWatchInvalidSequenceTokenError); ok && !retried {
+			cw.token = tokenErr.ExpectedSequenceToken
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		cw.token = token
+		cw.batch = nil
+		cw.size = 0
+		return nil
+	}
+}
@@ -0,0 +1,124 @@
+package notify
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+type cloudWatchPut struct {
+	events []CloudWatchEvent
+	token  string
+}
+
+// mockCloudWatch records requests and rejects the first sequence token
+type mockCloudWatch struct {
+	groups  []string
+	streams []string
+	puts    []cloudWatchPut
+	reject  bool
+}
+
+func (m *mockCloudWatch) CreateLogGroup(group string) error {
+	m.groups = append(m.groups, group)
+	return nil
+}
+
+func (m *mockCloudWatch) CreateLogStream(group, stream string) error {
+	m.streams = append(m.streams, group+"/"+stream)
+	return ErrCloudWatchResourceExists
+}
+
+func (m *mockCloudWatch) PutLogEvents(group, stream string, events []CloudWatchEvent, sequenceToken string) (string, error) {
+	m.puts = append(m.puts, cloudWatchPut{append([]CloudWatchEvent(nil), events...), sequenceToken})
+	if m.reject {
+		m.reject = false
+		return "", &CloudWatchInvalidSequenceTokenError{ExpectedSequenceToken: "expected"}
+	}
+	return "next", nil
+}
+
+func TestCloudWatchEndpoint(t *testing.T) {
+
+	client := &mockCloudWatch{reject: true}
+	cw := CloudWatchEndpoint(client, "group", "stream")
+
+	clock := time.Unix(1500000000, 0)
+	var slept time.Duration
+	cw.now = func() time.Time { return clock }
+	cw.sleep = func(d time.Duration) { slept += d; clock = clock.Add(d) }
+
+	cw.Write([]byte("first\n"))
+	clock = clock.Add(1500 * time.Millisecond)
+	cw.Write([]byte("second\nthird\n"))
+
+	if len(client.puts) != 0 {
+		t.Errorf("Events were not batched: %d requests", len(client.puts))
+	}
+
+	if err := cw.Flush(); err != nil {
+		t.Errorf("Unexpected flush error: %s", err.Error())
+	}
+
+	if len(client.groups) != 1 || len(client.streams) != 1 || client.streams[0] != "group/stream" {
+		t.Errorf("Log group and stream were not created: %v, %v", client.groups, client.streams)
+	}
+
+	// Rejected sequence token is refreshed
+	if len(client.puts) != 2 || client.puts[0].token != "" || client.puts[1].token != "expected" {
+		t.Fatalf("Sequence token was not refreshed: %v", client.puts)
+	}
+
+	// Requests are spaced by at least 200ms
+	if slept != cloudWatchPutInterval {
+		t.Errorf("Request limit was not respected: slept %v", slept)
+	}
+
+	expected := []CloudWatchEvent{
+		{Timestamp: 1500000000000, Message: "first"},
+		{Timestamp: 1500000001500, Message: "second"},
+		{Timestamp: 1500000001500, Message: "third"},
+	}
+	events := client.puts[1].events
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %d events, got %d", len(expected), len(events))
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Errorf("Expected event %v, got %v", expected[i], events[i])
+		}
+	}
+
+	// Next request uses the returned sequence token
+	cw.Write([]byte("fourth\n"))
+	cw.Close()
+	if len(client.puts) != 3 || client.puts[2].token != "next" || client.puts[2].events[0].Message != "fourth" {
+		t.Errorf("Buffered events were not sent on close: %v", client.puts)
+	}
+
+	if _, err := cw.Write([]byte("fifth\n")); err == nil {
+		t.Error("Writing to a closed endpoint did not fail")
+	}
+}
+
+func TestCloudWatchEndpointNotifier(t *testing.T) {
+
+	client := &mockCloudWatch{}
+	cw := CloudWatchEndpoint(client, "group", "stream")
+
+	notifier := NewNotifier("TestService", "TestInstance", true, false, false, 10, cw)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	send := notifier.Sender("cloudwatch")
+	send("hello cloudwatch")
+	notifier.Exit()
+
+	if len(client.puts) != 1 {
+		t.Fatalf("Expected 1 request on exit, got %d", len(client.puts))
+	}
+	events := client.puts[0].events
+	if len(events) != 2 || !strings.Contains(events[0].Message, "hello cloudwatch") || strings.HasSuffix(events[0].Message, "\n") {
+		t.Errorf("Unexpected events: %v", events)
+	}
+}
@@ -1,5 +1,25 @@
 package notify
 
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// knownLevels are the levels accepted by notifier.SetCodes (see RegisterLevel)
+var knownLevels = struct {
+	sync.Mutex
+	levels map[string]bool
+}{levels: map[string]bool{"MSG": true, "WRN": true, "ERR": true}}
+
+// isLevel indicates whether a level is known
+func isLevel(level string) bool {
+	knownLevels.Lock()
+	defer knownLevels.Unlock()
+	return knownLevels.levels[level]
+}
+
 // The map of notification codes should be detailed enough to satisfy the use
 // cases of your programm, but small enough to keep log-analysis meaningful.
 // You can use your own list via notifier.SetCodes()
@@ -9,6 +29,7 @@ var standardCodes = map[int][2]string{
 	2:   [2]string{"ERR", "ConfigurationError"},  // inapropriate configuration value (e.g. error parsing flags)
 	3:   [2]string{"ERR", "FailedAction"},        // failed attempt to do something, e.g open or write to a file
 	4:   [2]string{"ERR", "UserError"},           // e.g.
+	5:   [2]string{"WRN", "GeneralWarning"},      // Nonspecific warning (see notifier.Warn). Logged regardless of logAll
 	10:  [2]string{"ERR", "CatastrophicFailure"}, // an error that will (should) cause a panic, e.g. cannot start the server
 	100: [2]string{"MSG", "HTTP-StatusContinue"},
 	101: [2]string{"MSG", "HTTP-StatusSwitchingProtocols"},
@@ -69,5 +90,26 @@ var standardCodes = map[int][2]string{
 	508: [2]string{"ERR", "HTTP-StatusLoopDetected"},
 	510: [2]string{"ERR", "HTTP-StatusNotExtended"},
 	511: [2]string{"ERR", "HTTP-StatusNetworkAuthenticationRequired"},
-	999: [2]string{"ERR", "UnintendedCase"}, // [Restricted]. Should be used to track "should-never-happen" cases
+	998: [2]string{"ERR", "InternalWarning"}, // [Restricted]. Internal warnings of the notifier (see notifier.SetRouteWarnings)
+	999: [2]string{"ERR", "UnintendedCase"},  // [Restricted]. Should be used to track "should-never-happen" cases
+}
+
+// copyCodes returns a copy of notification codes, so that notifiers do not
+// share (and modify) the same map
+func copyCodes(codes map[int][2]string) map[int][2]string {
+	copied := make(map[int][2]string, len(codes))
+	for code, levelStatus := range codes {
+		copied[code] = levelStatus
+	}
+	return copied
+}
+
+// joinCodes lists codes in ascending order, separated by commas
+func joinCodes(codes []int) string {
+	sort.Ints(codes)
+	strs := make([]string, len(codes))
+	for i, code := range codes {
+		strs[i] = strconv.Itoa(code)
+	}
+	return strings.Join(strs, ", ")
 }
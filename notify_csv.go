@@ -0,0 +1,60 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"strings"
+)
+
+// CSVFormatter formats log entries as CSV records (RFC 4180), e.g. for
+// spreadsheets:
+//
+//	Timestamp,Service,Instance,Sender,Level,Code,Status,Message
+//	1481552048,MyService,MyServiceInstance,main,ERR,3,FailedAction,"Could not open ""a,b"""
+//
+// Empty log files opened by the notifier start with the header row. Like in
+// text mode, structured fields and other details are appended to the message
+// as key=value pairs. Line breaks of messages are handled according to
+// notifier.SetMultiline before the record is quoted.
+type CSVFormatter struct{}
+
+// Format turns a log entry into a CSV record
+func (f CSVFormatter) Format(entry LogEntry) string {
+	return csvRecord([]string{
+		strconv.Itoa(entry.Timestamp),
+		entry.Service,
+		entry.Instance,
+		entry.Sender,
+		entry.Level,
+		strconv.Itoa(entry.Code),
+		entry.Status,
+		entry.messageStr(),
+	})
+}
+
+// NeedsNewline returns true, since records are not terminated
+func (f CSVFormatter) NeedsNewline() bool {
+	return true
+}
+
+// Header returns the header row of CSV log files
+func (f CSVFormatter) Header() string {
+	return csvRecord(entryFields)
+}
+
+// csvRecord quotes fields as a CSV record without the line break
+func csvRecord(fields []string) string {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(fields)
+	w.Flush()
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+// SetCSVFormat makes the notifier write entries as CSV records (see
+// CSVFormatter). Like notifier.SetFormatter, it cannot be used after executing
+// notifier.Run().
+func (no *Notifier) SetCSVFormat() error {
+	return no.SetFormatter(CSVFormatter{})
+}
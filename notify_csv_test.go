@@ -0,0 +1,49 @@
+package notify
+
+import (
+	"encoding/csv"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestCSVFormatter(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestCSVFormatter.log"
+	defer os.Remove(logfile)
+
+	// Line breaks are kept by notifiers in JSON mode
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	if err := notifier.SetCSVFormat(); err != nil {
+		t.Fatal("Failed setting the CSV format: " + err.Error())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Failure("TestCSVFormatter")(3, `Could not open "a,b"`)
+	notifier.Sender("TestCSVFormatter")("first line\nsecond line")
+	notifier.Exit()
+
+	f, err := os.Open(logfile)
+	if err != nil {
+		t.Fatal("Failed opening the log file: " + err.Error())
+	}
+	defer f.Close()
+
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatal("Failed parsing the CSV log: " + err.Error())
+	}
+	if len(records) != 4 {
+		t.Fatalf("Expected a header row and 3 records, got %d rows", len(records))
+	}
+	if header := strings.Join(records[0], ","); header != "Timestamp,Service,Instance,Sender,Level,Code,Status,Message" {
+		t.Errorf("Unexpected header row: '%s'", header)
+	}
+	if r := records[1]; r[3] != "TestCSVFormatter" || r[4] != "ERR" || r[5] != "3" || !strings.HasPrefix(r[7], `Could not open "a,b"`) {
+		t.Errorf("Unexpected record: %v", r)
+	}
+	if r := records[2]; r[7] != "first line\nsecond line" {
+		t.Errorf("Line breaks should be quoted, got '%s'", r[7])
+	}
+}
@@ -0,0 +1,66 @@
+package notify
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NewNotifierFromEnv creates a notifier configured by environment variables
+// of the prefix (default: NOTIFY):
+//
+//	NOTIFY_SERVICE    name of the service (default: name of the executable)
+//	NOTIFY_INSTANCE   name of the instance (default: host name)
+//	NOTIFY_JSON       write log entries as JSON (default: false)
+//	NOTIFY_LOG_ALL    log messages as well as errors (default: true)
+//	NOTIFY_ASYNC      do not block senders (default: false)
+//	NOTIFY_CAPACITY   capacity of the notes channel (default: 100)
+//	NOTIFY_ENDPOINTS  comma separated file paths, stdout or stderr (default: stdout)
+//
+// An error is returned if a variable cannot be parsed.
+func NewNotifierFromEnv(prefix string) (*Notifier, error) {
+	if prefix == "" {
+		prefix = "NOTIFY"
+	}
+	env := func(name string) string {
+		return strings.TrimSpace(os.Getenv(prefix + "_" + name))
+	}
+
+	service := env("SERVICE")
+	if service == "" {
+		service = filepath.Base(os.Args[0])
+	}
+	instance := env("INSTANCE")
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+
+	flags := map[string]bool{"JSON": false, "LOG_ALL": true, "ASYNC": false}
+	for name := range flags {
+		if value := env(name); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, errors.New("notify: invalid " + prefix + "_" + name + " '" + value + "'")
+			}
+			flags[name] = b
+		}
+	}
+
+	capacity := 100
+	if value := env("CAPACITY"); value != "" {
+		c, err := strconv.Atoi(value)
+		if err != nil || c < 0 {
+			return nil, errors.New("notify: invalid " + prefix + "_CAPACITY '" + value + "'")
+		}
+		capacity = c
+	}
+
+	endpoints := splitEndpoints(env("ENDPOINTS"))
+	if len(endpoints) == 0 {
+		endpoints = []interface{}{os.Stdout}
+	}
+
+	return NewNotifier(service, instance, flags["LOG_ALL"], flags["ASYNC"], flags["JSON"], capacity, endpoints...), nil
+}
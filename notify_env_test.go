@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNewNotifierFromEnv(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestNewNotifierFromEnv.log"
+	defer os.Remove(logfile)
+
+	t.Setenv("TESTENV_SERVICE", "MyService")
+	t.Setenv("TESTENV_JSON", "true")
+	t.Setenv("TESTENV_LOG_ALL", "false")
+	t.Setenv("TESTENV_CAPACITY", "42")
+	t.Setenv("TESTENV_ENDPOINTS", logfile+", stderr")
+
+	notifier, err := NewNotifierFromEnv("TESTENV")
+	if err != nil {
+		t.Fatal("Failed creating a notifier: " + err.Error())
+	}
+	defer notifier.Exit()
+
+	if notifier.service != "MyService" || notifier.instance == "" || !notifier.json || notifier.logAll || notifier.async || notifier.Capacity() != 42 {
+		t.Errorf("Environment was not applied: service=%s, instance=%s, json=%t, logAll=%t, async=%t, capacity=%d",
+			notifier.service, notifier.instance, notifier.json, notifier.logAll, notifier.async, notifier.Capacity())
+	}
+	if ptrs := notifier.endpoints.endpointsPtr; len(ptrs) != 2 || notifier.endpoints.files[0] != logfile || ptrs[1] != os.Stderr {
+		t.Errorf("Unexpected endpoints: %v", ptrs)
+	}
+
+	t.Setenv("TESTENV_ASYNC", "maybe")
+	if _, err := NewNotifierFromEnv("TESTENV"); err == nil {
+		t.Error("Invalid variables should be reported")
+	}
+}
@@ -0,0 +1,61 @@
+package notify
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+// RegisterFlags registers the configuration flags of a notifier on the flag
+// set and returns a function building the notifier. The builder has to be
+// called after parsing the flags, e.g.:
+//
+//	build := notify.RegisterFlags(flag.CommandLine)
+//	flag.Parse()
+//	notifier := build()
+//
+// Registered flags: -log.service, -log.instance, -log.file (comma separated
+// file paths, stdout or stderr, default: os.Stdout), -log.json, -log.async, -log.cap and
+// -log.level (MSG logs all notes, ERR only errors).
+func RegisterFlags(fs *flag.FlagSet) func() *Notifier {
+	service := fs.String("log.service", "", "Name of the service")
+	instance := fs.String("log.instance", "", "Name of the service instance")
+	files := fs.String("log.file", "", "Comma separated log files (default: standard output)")
+	json := fs.Bool("log.json", false, "Write log entries as JSON")
+	async := fs.Bool("log.async", false, "Do not block senders")
+	capacity := fs.Int("log.cap", 100, "Capacity of the notes channel")
+	level := fs.String("log.level", "MSG", "Lowest logged level (MSG or ERR)")
+
+	return func() *Notifier {
+		endpoints := splitEndpoints(*files)
+
+		logAll := true
+		switch strings.ToUpper(*level) {
+		case "MSG":
+		case "ERR":
+			logAll = false
+		default:
+			syswarn("Unknown level " + *level + ". Logging all notes")
+		}
+
+		return NewNotifier(*service, *instance, logAll, *async, *json, *capacity, endpoints...)
+	}
+}
+
+// splitEndpoints returns the endpoints of a comma separated list of file paths.
+// "stdout" and "stderr" stand for the standard streams.
+func splitEndpoints(list string) []interface{} {
+	endpoints := []interface{}{}
+	for _, file := range strings.Split(list, ",") {
+		switch file = strings.TrimSpace(file); file {
+		case "":
+		case "stdout":
+			endpoints = append(endpoints, os.Stdout)
+		case "stderr":
+			endpoints = append(endpoints, os.Stderr)
+		default:
+			endpoints = append(endpoints, file)
+		}
+	}
+	return endpoints
+}
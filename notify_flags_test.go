@@ -0,0 +1,34 @@
+package notify
+
+import (
+	"flag"
+	"os"
+	"testing"
+)
+
+func TestRegisterFlags(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestRegisterFlags.log"
+	defer os.Remove(logfile)
+
+	fs := flag.NewFlagSet("TestRegisterFlags", flag.ContinueOnError)
+	build := RegisterFlags(fs)
+
+	if err := fs.Parse([]string{"-log.service", "MyService", "-log.file", logfile, "-log.json", "-log.level", "ERR"}); err != nil {
+		t.Fatal("Failed parsing flags: " + err.Error())
+	}
+
+	notifier := build()
+	defer notifier.Exit()
+
+	if !notifier.json || notifier.logAll || notifier.service != "MyService" {
+		t.Errorf("Flags were not applied: json=%t, logAll=%t, service=%s", notifier.json, notifier.logAll, notifier.service)
+	}
+	if len(notifier.endpoints.endpointsPtr) != 1 || notifier.endpoints.files[0] != logfile {
+		t.Error("Log file was not used as the endpoint")
+	}
+
+	if flag.Lookup("log.json") != nil {
+		t.Error("Flags should not be registered on the default flag set")
+	}
+}
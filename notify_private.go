@@ -1,34 +1,201 @@
 package notify
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // Notification is the standard error struct used in notify
 type notification struct {
 	code    int
 	message string
+	caller  string // Location that created the notification, e.g. main.go:42 (optional)
+	sent    bool   // Indicator of whether the notification has been sent (returned by send functions)
+	cause   error  // Underlying error (see notifier.FailureErr)
 }
 
 // note is a struct used to transport notifications (string, error, notify.Notification)
 // to the note channel.
 type note struct {
-	Sender  string
-	Value   interface{}
-	Confirm chan<- bool
+	Sender    string
+	Value     interface{}
+	Confirm   chan<- bool
+	Func      string                 // Name of the function that sent the note (optional)
+	Fields    map[string]interface{} // Structured fields of the note (optional)
+	Frames    []Frame                // Stack frames of the sending function (optional)
+	TraceID   string                 // Correlation ID of the sender (optional)
+	Goroutine int64                  // ID of the sending goroutine (optional)
+	Batch     []*note                // Notes logged contiguously instead of the value (see notifier.SendBatch)
+	Last      bool                   // Indicator of whether this is the last note before exiting
+	Digest    bool                   // Indicator of whether the note is a digest
+	Summary   bool                   // Indicator of whether the note carries the exit summary (never suppressed)
+	Timeout   time.Duration          // Maximum wait for free capacity of the note channel (see notifier.SendWithTimeout)
+}
+
+// confirm signals that the note has been processed (if a confirm channel is
+// set). Confirm channels are buffered (capacity 1) and signalled once, so a
+// waiter that reads its channel late cannot stall the consumer of the note
+// channel.
+func (n *note) confirm() {
+	if n.Confirm != nil {
+		n.Confirm <- true
+	}
+}
+
+// lineWriter sends the lines written to it as messages
+type lineWriter struct {
+	sync.Mutex           // Lock the buffer
+	no         *Notifier // Notifier receiving the lines
+	sender     string    // Sender of the lines
+	buf        []byte    // Incomplete line
+}
+
+// Write sends all complete lines and buffers the rest
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	lw.Lock()
+	defer lw.Unlock()
+
+	lw.buf = append(lw.buf, p...)
+
+	var err error
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		line := strings.TrimSuffix(string(lw.buf[:i]), "\r")
+		lw.buf = lw.buf[i+1:]
+
+		if serr := lw.no.send(lw.no.newNote(lw.sender, line, nil), lw.no.async); serr != nil && err == nil {
+			err = serr
+		}
+	}
+
+	return len(p), err
+}
+
+// digest counts the occurrences of a notification code
+type digest struct {
+	interval time.Duration // Interval between digest entries
+	start    time.Time     // Time of the first occurrence in the current interval
+	count    int           // Number of occurrences in the current interval
+	sender   string        // Sender of the latest occurrence
+	sample   string        // Message of the latest occurrence
+}
+
+// sampler samples the occurrences of a notification code
+type sampler struct {
+	rate   float64       // Share of logged occurrences after the first one
+	window time.Duration // Duration of sampling after the first occurrence
+	start  time.Time     // Time of the first occurrence in the current window
+	credit float64       // Accumulated rate, an occurrence is logged once it reaches 1
+}
+
+// namedWriter is an endpoint with a name (see NamedWriter)
+type namedWriter struct {
+	io.Writer
+	name string
+}
+
+// Flush flushes the named endpoint
+func (w *namedWriter) Flush() error {
+	return flushEndpoint(w.Writer)
+}
+
+// Close closes the named endpoint (if it can be closed)
+func (w *namedWriter) Close() error {
+	if c, ok := w.Writer.(io.Closer); ok && w.Writer != os.Stdout && w.Writer != os.Stderr {
+		return c.Close()
+	}
+	return nil
+}
+
+// bufferedFile is a log file opened by the notifier, which is written through
+// a buffer (see notifier.SetFileBuffering)
+type bufferedFile struct {
+	*bufio.Writer
+	file *os.File
+}
+
+// Close writes the buffered data and closes the file
+func (f *bufferedFile) Close() error {
+	ferr := f.Flush()
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// batch holds formatted entries until they are written to the endpoints
+// (see notifier.SetWriteBatching)
+type batch struct {
+	buf   []byte // Formatted entries
+	count int    // Number of entries
 }
 
 type endpoints struct {
-	sync.Mutex              // Lock resources for notify.log() or notify.Exit use only
-	endpointsPtr []*os.File // Slice of endpoints the logger should write to
+	sync.Mutex               // Lock resources for notify.log() or notify.Exit use only
+	endpointsPtr []io.Writer // Slice of endpoints the logger should write to
+	files        []string    // Paths of the log files opened by the notifier, by endpoint index ("": other endpoints)
+	arrays       []int       // Entries of the open JSON array of each endpoint (-1: none, see notifier.SetJSONArray)
+}
+
+// add appends an endpoint and the path of its log file ("" if it is not a log
+// file opened by the notifier)
+func (e *endpoints) add(w io.Writer, path string) {
+	e.endpointsPtr = append(e.endpointsPtr, w)
+	e.files = append(e.files, path)
+	e.arrays = append(e.arrays, -1)
+}
+
+// remove removes the i-th endpoint
+func (e *endpoints) remove(i int) {
+	e.endpointsPtr = append(e.endpointsPtr[:i], e.endpointsPtr[i+1:]...)
+	e.files = append(e.files[:i], e.files[i+1:]...)
+	e.arrays = append(e.arrays[:i], e.arrays[i+1:]...)
+}
+
+// sameWriter indicates whether two writers are the same endpoint. Only
+// pointers (e.g. *os.File) are compared, since comparing other writers (e.g.
+// structs with slices) may panic and equal values are not the same endpoint.
+func sameWriter(a io.Writer, b io.Writer) bool {
+	if a == nil || b == nil || reflect.TypeOf(a).Kind() != reflect.Ptr || reflect.TypeOf(b).Kind() != reflect.Ptr {
+		return false
+	}
+	return a == b
+}
+
+type statistics struct {
+	sync.Mutex // Lock counters
+	Stats
+	highest    string // Most severe level logged (see notifier.HighestLevelSeen)
+	lastFailed bool   // Writing the latest line failed for at least one endpoint (see notifier.Health)
+}
+
+// levelSeverity ranks the built-in levels (see notifier.HighestLevelSeen)
+var levelSeverity = map[string]int{"MSG": 1, "WRN": 2, "ERR": 3}
+
+type verbosity struct {
+	sync.RWMutex        // Lock the threshold and logAll (changeable on a running notifier)
+	minLevel     string // Least severe level logged (see notifier.SetMinLevel)
 }
 
 type operations struct {
@@ -37,34 +204,539 @@ type operations struct {
 	running      bool // Indicator of whether notifier.Run has been started
 }
 
-// Slice containing pointers to open files.
+type remap struct {
+	sync.RWMutex             // Lock the remapping (changeable on a running notifier)
+	codes        map[int]int // Replacements of notification codes
+}
+
+type asyncPool struct {
+	sync.Mutex            // Lock the lazy start of the workers and the counters
+	workers    int        // Number of workers (see notifier.SetAsyncWorkers)
+	ordered    bool       // Route notes through a single worker (see notifier.SetOrderedAsync)
+	queue      chan *note // Notes waiting for a worker (nil until the first asynchronous send)
+	queued     int        // Number of notes handed over to the workers
+	routed     int        // Number of notes routed by the workers
+	progress   *sync.Cond // Signaled whenever a worker has routed a note
+}
+
+type pause struct {
+	sync.Mutex               // Lock the resume channel (independent of operations, which might be held by blocked senders)
+	resume     chan struct{} // Non-nil while the notifier is paused. Closed on resume
+}
+
+// Symbols that are replaced in text mode
+var separators = []string{"\t", "\n", "\r", "\b", "\f", "\v"}
+
+// Escapes of separators in text mode (see MultilineEscape)
+var multilineEscaper = strings.NewReplacer("\\", "\\\\", "\t", "\\t", "\n", "\\n", "\r", "\\r", "\b", "\\b", "\f", "\\f", "\v", "\\v")
+
+// Codes of the level tags parsed by default (see notifier.SetParseLevelPrefix)
+var defaultLevelPrefixes = map[string]int{"ERROR": 1, "ERR": 1, "WARN": 5, "WARNING": 5, "INFO": 0, "DEBUG": 0}
+
+// Slice containing the paths of log files used by notifiers.
 var usedFileEndpoints []string
 
-// syswarn prints a warning without logging it
+// Lock usedFileEndpoints
+var usedFileEndpointsLock sync.Mutex
+
+// Default grace period of notifier.Exit()
+var exitGrace struct {
+	sync.Mutex
+	period time.Duration
+}
+
+// exitGracePeriod returns the default grace period of notifier.Exit()
+func exitGracePeriod() time.Duration {
+	exitGrace.Lock()
+	defer exitGrace.Unlock()
+	return exitGrace.period
+}
+
+// Registry of service and instance names used by notifiers
+var usedInstances struct {
+	sync.Mutex
+	enforce bool           // Indicator of whether shared names should be reported
+	names   map[string]int // Number of notifiers per service and instance
+}
+
+// registerInstance registers the names of a notifier. It returns false if the
+// names are already used by another notifier.
+func registerInstance(service string, instance string) bool {
+	usedInstances.Lock()
+	defer usedInstances.Unlock()
+
+	if usedInstances.names == nil {
+		usedInstances.names = make(map[string]int)
+	}
+	key := service + "\t" + instance
+	usedInstances.names[key]++
+	return usedInstances.names[key] == 1
+}
+
+// deregisterInstance releases the names of a notifier
+func deregisterInstance(service string, instance string) {
+	usedInstances.Lock()
+	defer usedInstances.Unlock()
+
+	key := service + "\t" + instance
+	if usedInstances.names[key]--; usedInstances.names[key] <= 0 {
+		delete(usedInstances.names, key)
+	}
+}
+
+// uniqueInstancesEnforced indicates if shared names should be reported
+func uniqueInstancesEnforced() bool {
+	usedInstances.Lock()
+	defer usedInstances.Unlock()
+	return usedInstances.enforce
+}
+
+// osExit terminates the program (replaceable in tests)
+var osExit = os.Exit
+
+// internalWarnings is the sink of internal warnings (nil: disabled)
+var internalWarnings = struct {
+	sync.Mutex
+	w io.Writer
+}{w: os.Stderr}
+
+// syswarn writes a warning to the internal warning sink without logging it
 func syswarn(warn string) {
-	fmt.Println("notify:", warn)
+	internalWarnings.Lock()
+	defer internalWarnings.Unlock()
+
+	if internalWarnings.w != nil {
+		fmt.Fprintln(internalWarnings.w, "notify:", warn)
+	}
+}
+
+// warn logs an internal warning as a notification of code 998 if routing
+// warnings is enabled (see notifier.SetRouteWarnings). It never blocks, so it
+// can be used by notifier.Run(), even while notifier.Exit() holds the
+// operations lock. Warnings that cannot be logged are written to the internal
+// warning sink instead.
+func (no *Notifier) warn(warning string) {
+	if !no.routeWarnings || !no.ops.TryRLock() {
+		syswarn(warning)
+		return
+	}
+	defer no.ops.RUnlock()
+
+	if _, ok := no.codes()[998]; ok && !no.ops.halt {
+		select {
+		case no.noteChan <- &note{Sender: "notifier", Value: notification{code: 998, message: warning}}:
+			return
+		default:
+		}
+	}
+	syswarn(warning)
+}
+
+// claimFileEndpoint registers a log file as used. It returns false if the log
+// file is already used by another notifier.
+func claimFileEndpoint(logfile string) bool {
+	usedFileEndpointsLock.Lock()
+	defer usedFileEndpointsLock.Unlock()
+
+	for _, e := range usedFileEndpoints {
+		if e == logfile {
+			return false
+		}
+	}
+	usedFileEndpoints = append(usedFileEndpoints, logfile)
+	return true
+}
+
+// releaseFileEndpoint allows other notifiers to use the log file again
+func releaseFileEndpoint(logfile string) {
+	usedFileEndpointsLock.Lock()
+	defer usedFileEndpointsLock.Unlock()
+
+	for i, e := range usedFileEndpoints {
+		if e == logfile {
+			usedFileEndpoints = append(usedFileEndpoints[:i], usedFileEndpoints[i+1:]...)
+			return
+		}
+	}
+}
+
+// attach adds an endpoint (file path or io.Writer) to the notifier, unless it
+// is already attached. Nil endpoints (see EnvGatedEndpoint) are skipped. The
+// endpoints have to be locked by the caller.
+func (no *Notifier) attach(endpoint interface{}) error {
+
+	var f io.Writer
+	var path string
+	switch w := endpoint.(type) {
+
+	case nil:
+		return nil
+
+	case string:
+
+		// disallow writing to the same file
+		if !claimFileEndpoint(w) {
+			return errors.New("file endpoint " + w + " is already used by another notifier")
+		}
+
+		lf, err := no.openLogFile(w)
+		if err == nil {
+			f = no.bufferFile(lf)
+			path = w
+			no.writeHeader(f, path)
+		} else {
+			releaseFileEndpoint(w)
+			f = lf // os.Stdout
+		}
+
+	case io.Writer:
+		f = canonicalEndpoint(w)
+
+	default:
+		return errors.New("endpoint is not supported. Either provide a file path (string) or an io.Writer (e.g. *os.File)")
+	}
+
+	// Ignore duplicates
+	for _, e := range no.endpoints.endpointsPtr {
+		if sameWriter(e, f) {
+			return nil
+		}
+	}
+	no.endpoints.add(f, path)
+	if no.array.started {
+		no.openArray(len(no.endpoints.endpointsPtr) - 1)
+	}
+
+	return nil
+}
+
+// canonicalEndpoint replaces handles of the standard output and standard error
+// (e.g. a second handle of /dev/stdout) by os.Stdout and os.Stderr, so that
+// duplicates of the standard streams are detected.
+func canonicalEndpoint(w io.Writer) io.Writer {
+	f, ok := w.(*os.File)
+	if !ok || f == nil || f == os.Stdout || f == os.Stderr {
+		return w
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		return w
+	}
+	for _, std := range []*os.File{os.Stdout, os.Stderr} {
+		if stdInfo, serr := std.Stat(); serr == nil && os.SameFile(info, stdInfo) {
+			return std
+		}
+	}
+	return w
+}
+
+// reopenFile replaces the i-th endpoint (a log file opened by the notifier) by
+// a new handle of the same path. The previous handle is kept if the file cannot
+// be opened. The endpoints have to be locked by the caller.
+func (no *Notifier) reopenFile(i int) error {
+	endpoint := no.endpoints.endpointsPtr[i]
+	path := no.endpoints.files[i]
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	no.closeArray(i) // the array of the previous file
+	w := no.bufferFile(f)
+	no.endpoints.endpointsPtr[i] = w
+	endpoint.(io.Closer).Close() // writes the buffered data to the previous file
+	no.writeHeader(w, path)
+	if no.array.started {
+		no.openArray(i)
+	}
+	return nil
+}
+
+// fileHeader is the header line of new log files (see notifier.SetFileHeader)
+type fileHeader struct {
+	Header   string   `json:"Header"`  // Always fileHeaderName
+	Version  int      `json:"Version"` // Version of the header
+	Format   string   `json:"Format"`  // json, text or custom (see notifier.SetFormatter)
+	Service  string   `json:"Service"`
+	Instance string   `json:"Instance"`
+	Fields   []string `json:"Fields"`  // Fields of the entries (columns in text mode)
+	Created  int64    `json:"Created"` // Unix time of the header
+}
+
+// fileHeaderName identifies header lines (see LogReader)
+const fileHeaderName = "fractal-notify"
+
+// entryFields are the fields of every log entry, in the order of the columns
+// of the text format
+var entryFields = []string{"Timestamp", "Service", "Instance", "Sender", "Level", "Code", "Status", "Message"}
+
+// headerFormatter is implemented by formatters whose log files start with a
+// header row (see CSVFormatter)
+type headerFormatter interface {
+	Header() string
+}
+
+// writeHeader writes the header line to an empty log file opened by the
+// notifier, if headers are enabled (see notifier.SetFileHeader) or the
+// formatter has a header row. The endpoints have to be locked by the caller.
+func (no *Notifier) writeHeader(endpoint io.Writer, path string) {
+	hf, ok := no.formatter.(headerFormatter)
+	if (!ok && !no.fileHeader) || no.array.enabled {
+		return
+	}
+
+	f, ok := endpoint.(*os.File)
+	if bf, buffered := endpoint.(*bufferedFile); buffered {
+		if bf.Buffered() > 0 {
+			return
+		}
+		f, ok = bf.file, true
+	}
+	if !ok {
+		return
+	}
+	if info, err := f.Stat(); err != nil || info.Size() > 0 {
+		return
+	}
+
+	var header []byte
+	if hf != nil {
+		header = []byte(hf.Header())
+	} else {
+		format := "text"
+		if no.formatter != nil {
+			format = "custom"
+		} else if no.json {
+			format = "json"
+		}
+		header, _ = json.Marshal(fileHeader{
+			Header:   fileHeaderName,
+			Version:  1,
+			Format:   format,
+			Service:  no.service,
+			Instance: no.instance,
+			Fields:   entryFields,
+			Created:  no.now().Unix(),
+		})
+	}
+	if _, err := endpoint.Write(append(header, '\n')); err != nil {
+		syswarn("failed writing the header of " + path + ": " + err.Error())
+	}
+}
+
+// bufferFile wraps a log file opened by the notifier in a buffer, unless
+// buffering is disabled
+func (no *Notifier) bufferFile(f *os.File) io.Writer {
+	if no.fileBuffer <= 0 {
+		return f
+	}
+	return &bufferedFile{Writer: bufio.NewWriterSize(f, no.fileBuffer), file: f}
+}
+
+// flushFiles writes the buffered data of the log files opened by the notifier.
+// The endpoints have to be locked by the caller.
+func (no *Notifier) flushFiles() {
+	for i, endpoint := range no.endpoints.endpointsPtr {
+		if bf, ok := endpoint.(*bufferedFile); ok {
+			if err := bf.Flush(); err != nil {
+				syswarn("failed flushing " + no.endpoints.files[i] + ": " + err.Error()) // do not log to avoid infinite loop
+				no.failedLine()
+			}
+		}
+	}
+}
+
+// rotateIfDue rotates the log files once the scheduled time has passed
+func (no *Notifier) rotateIfDue() {
+	now := no.now()
+	if no.nextRotation.IsZero() || now.Before(no.nextRotation) {
+		return
+	}
+
+	no.endpoints.Lock()
+	no.flushBatch() // batched entries belong to the rotated files
+	no.rotate(no.nextRotation)
+	no.endpoints.Unlock()
+
+	no.nextRotation = no.rotation.next(now)
+}
+
+// rotationLayout is the layout of the times of rotated log files
+// (<file>.<time>)
+const rotationLayout = "20060102-150405"
+
+// rotate renames the log files opened by the notifier to <file>.<time> and
+// opens new files. The endpoints have to be locked by the caller.
+func (no *Notifier) rotate(at time.Time) {
+	for i, path := range no.endpoints.files {
+		if path == "" {
+			continue
+		}
+
+		rotated := path + "." + at.Format(rotationLayout)
+		if err := os.Rename(path, rotated); err != nil {
+			no.warn("failed rotating " + path + ": " + err.Error())
+			continue
+		}
+		if err := no.reopenFile(i); err != nil {
+			no.warn("failed opening " + path + " after rotation, keeping the rotated file: " + err.Error())
+			continue
+		}
+
+		if no.compressRotated {
+			no.compress(path, rotated)
+		}
+	}
+}
+
+// compress gzips a rotated log file in the background and removes the oldest
+// compressed backups of the log file beyond the retention count. Compressions
+// run one at a time, so that pruning does not race with other compressions.
+func (no *Notifier) compress(path string, rotated string) {
+	no.compressions.Add(1)
+	go func() {
+		defer no.compressions.Done()
+		no.compressLock.Lock()
+		defer no.compressLock.Unlock()
+
+		if err := gzipFile(rotated); err != nil {
+			no.warn("failed compressing " + rotated + ": " + err.Error())
+			return
+		}
+		if no.keepCompressed > 0 {
+			no.pruneBackups(path, no.keepCompressed)
+		}
+	}()
+}
+
+// gzipFile compresses a file to <file>.gz and removes the original file
+func gzipFile(name string) (err error) {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(name + ".gz") // do not leave partial backups
+		}
+	}()
+
+	gz := gzip.NewWriter(dst)
+	if _, err = io.Copy(gz, src); err != nil {
+		return err
+	}
+	if err = gz.Close(); err != nil {
+		return err
+	}
+
+	src.Close()
+	return os.Remove(name)
+}
+
+// pruneBackups removes the oldest compressed backups of a log file
+// (<file>.<time>.gz), so that keep backups remain. Other files are never
+// removed, e.g. backups of another log file named <file>.<suffix>.
+func (no *Notifier) pruneBackups(path string, keep int) {
+	entries, err := ioutil.ReadDir(filepath.Dir(path))
+	if err != nil {
+		no.warn("failed listing backups of " + path + ": " + err.Error())
+		return
+	}
+
+	prefix := filepath.Base(path) + "."
+	backups := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".gz") {
+			continue
+		}
+		if _, err := time.Parse(rotationLayout, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz")); err == nil {
+			backups = append(backups, name)
+		}
+	}
+	sort.Strings(backups) // times of rotation sort chronologically
+
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(filepath.Dir(path), backups[0])); err != nil {
+			no.warn("failed removing backup " + backups[0] + ": " + err.Error())
+		}
+		backups = backups[1:]
+	}
+}
+
+// endpointID returns the id of an endpoint: the name of a named endpoint, the
+// path of a log file or "stdout" and "stderr". Other endpoints have no id. The
+// endpoints have to be locked by the caller.
+func (no *Notifier) endpointID(i int) string {
+	endpoint := no.endpoints.endpointsPtr[i]
+	if named, ok := endpoint.(*namedWriter); ok {
+		return named.name
+	}
+	if path := no.endpoints.files[i]; path != "" {
+		return path
+	}
+
+	if f, ok := endpoint.(*os.File); ok {
+		switch f {
+		case os.Stdout:
+			return "stdout"
+		case os.Stderr:
+			return "stderr"
+		}
+	}
+	return ""
+}
+
+// flushEndpoint flushes buffered endpoints and syncs files
+func flushEndpoint(endpoint io.Writer) error {
+	switch w := endpoint.(type) {
+	case *bufferedFile:
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		return w.file.Sync()
+	case interface{ Flush() error }:
+		return w.Flush()
+	case *os.File:
+		if w == os.Stdout || w == os.Stderr {
+			return nil // syncing a terminal or pipe fails
+		}
+		return w.Sync()
+	}
+	return nil
 }
 
 // openLogFile opens a log file and returns a reference to it
-func openLogFile(logfile string) (*os.File, error) {
+func (no *Notifier) openLogFile(logfile string) (*os.File, error) {
 
 	// Check validity of file
 	if strings.ToLower(filepath.Ext(logfile)) != ".log" {
-		syswarn("log file's extension is not *.log")
+		no.warn("log file's extension is not *.log")
 	}
 	if f, err := os.Stat(logfile); os.IsNotExist(err) {
 		if _, berr := os.Stat(filepath.Dir(logfile)); os.IsNotExist(berr) {
 			if derr := os.MkdirAll(filepath.Dir(logfile), 0700); derr != nil {
-				syswarn("log file directory does not exist. Failed creating it: " + derr.Error())
+				no.warn("log file directory does not exist. Failed creating it: " + derr.Error())
 			}
 		}
 	} else if err == nil && f.IsDir() {
-		syswarn("the provided log file is a directory. Will not be able to write notifications to file.")
+		no.warn("the provided log file is a directory. Will not be able to write notifications to file.")
 	}
 
 	// Open the log file
 	if f, err := os.OpenFile(logfile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600); err != nil {
-		syswarn("Failed opening log file: " + err.Error() + ". Using os.Stdout instead")
+		no.warn("Failed opening log file: " + err.Error() + ". Using os.Stdout instead")
 		return os.Stdout, err
 	} else {
 		return f, nil
@@ -78,11 +750,49 @@ func (no *Notifier) isReady() bool {
 	return no.ops.running
 }
 
+// channel returns the current note channel
+func (no *Notifier) channel() chan *note {
+	no.chanLock.RLock()
+	defer no.chanLock.RUnlock()
+	return no.noteChan
+}
+
+// retiredNote receives the next note left in a note channel replaced by
+// notifier.Resize. Once all replaced channels are empty (they stay empty as
+// senders only use the current channel), it returns nil and the channel that
+// was current at that time. If notifier.Resize replaces that channel later on,
+// its remaining notes are still received before those of the new channel.
+func (no *Notifier) retiredNote() (*note, chan *note) {
+	no.chanLock.Lock()
+	defer no.chanLock.Unlock()
+
+	for len(no.retired) > 0 {
+		select {
+		case n := <-no.retired[0]:
+			return n, nil
+		default:
+			no.retired = no.retired[1:]
+		}
+	}
+	return nil, no.noteChan
+}
+
+// paused returns a channel that is closed once the notifier is resumed, or nil
+// if the notifier is not paused
+func (no *Notifier) paused() <-chan struct{} {
+	no.pause.Lock()
+	defer no.pause.Unlock()
+	if no.pause.resume == nil {
+		return nil
+	}
+	return no.pause.resume
+}
+
 // noteToSelf creates a note. This function is used to communicate internal problems.
 // This note will be logged
 func (no *Notifier) noteToSelf(value interface{}) error {
 
-	resp := send("notifier", value, nil, no.noteChan, no.async, &no.ops)
+	resp := no.send(&note{Sender: "notifier", Value: value}, no.async)
 
 	switch err := resp.(type) {
 
@@ -96,79 +806,276 @@ func (no *Notifier) noteToSelf(value interface{}) error {
 
 }
 
+// newNote creates a note for the value. It has to be called directly by the
+// function the user called, so that the calling function can be determined.
+func (no *Notifier) newNote(sender string, value interface{}, confirm chan<- bool) *note {
+	n := &note{Sender: sender, Value: value, Confirm: confirm}
+	if no.includeFunc {
+		n.Func = callerFunc(2)
+	}
+	if no.includeGoroutine {
+		n.Goroutine = goroutineID()
+	}
+	if no.stackDepth > 0 {
+		code := 0
+		if err, ok := value.(error); ok {
+			code = errorCode(err)
+		}
+		if code >= no.stackMinCode {
+			n.Frames = callerFrames(2, no.stackDepth)
+		}
+	}
+	return n
+}
+
 // id returns notifier's details
 func (no *Notifier) id() string {
 	return fmt.Sprintf("Notifier[%s][%s] %p", no.service, no.instance, no)
 }
 
+// codes returns the notification codes of the notifier. The code table is
+// replaced, but never changed, on a running notifier (see notifier.LoadCodes).
+func (no *Notifier) codes() map[int][2]string {
+	no.codesLock.RLock()
+	defer no.codesLock.RUnlock()
+	return no.notificationCodes
+}
+
 // isOK check is some assumptions made by the notifier are still valid
 // notify.notifier expects some notification codes to be available at all times.
+// The panic is intentional: a notifier without system codes is misconfigured
+// and is not covered by the panic recovery in notifier.log().
 func (no *Notifier) isOK() {
 
 	// Check codes
 	sysCodes := []int{0, 1, 999}
 	for _, code := range sysCodes {
-		if _, okStd := no.notificationCodes[code]; !okStd {
+		if _, okStd := no.codes()[code]; !okStd {
 			panic(fmt.Sprintf("notify: notificationCodes[%d] is not available", code))
 		}
 	}
 }
 
-// newf formats according to a format specifier and builds a Notification struct
-func newf(code int, callerDepth int, format string, a ...interface{}) error {
+// newf formats according to a format specifier and builds a Notification struct.
+// The location of the caller (at callerDepth) is kept apart from the message.
+func newf(code int, callerDepth int, format string, a ...interface{}) error {
+
+	message := format
+	if len(a) > 0 {
+		message = fmt.Sprintf(format, a...)
+	}
+
+	if code < 0 {
+		syswarn(fmt.Sprintf("An error should have a non-zero code. Changing %d to 1", code))
+		code = 1
+	}
+
+	// Append some runtime information
+	n := notification{code: code, message: message}
+	if _, fn, line, ok := runtime.Caller(callerDepth); ok {
+		n.caller = filepath.Base(fn) + ":" + strconv.Itoa(line)
+	}
+
+	return n
+}
+
+// codeOf returns the code an error is logged with: its own code (see
+// errorCode) if it is a known notification code, 1 otherwise
+func (no *Notifier) codeOf(err error) int {
+	code := errorCode(err)
+	if _, known := no.codes()[code]; known {
+		return code
+	}
+	return 1
+}
+
+// errorCode returns the code of an error: the code of a notification, the
+// positive code of a Coder or 1. The code is not checked against the codes of
+// a notifier.
+func errorCode(err error) int {
+	switch e := err.(type) {
+	case notification:
+		return e.code
+	case Coder:
+		if code := e.Code(); code > 0 {
+			return code
+		}
+	}
+	return 1
+}
+
+// route puts the note into the note channel. ErrNotifierClosed is returned if
+// the notifier does not accept notes anymore.
+func (no *Notifier) route(n *note) error {
+	no.ops.RLock()
+	defer no.ops.RUnlock()
+
+	if no.ops.halt {
+		n.confirm()
+		syswarn(n.Sender + " cannot send to a closed channel")
+		return ErrNotifierClosed
+	}
+
+	if n.Timeout <= 0 {
+		no.noteChan <- n
+		return nil
+	}
+
+	timer := time.NewTimer(n.Timeout)
+	defer timer.Stop()
+	select {
+	case no.noteChan <- n:
+		return nil
+	case <-timer.C:
+		return ErrSendTimeout
+	}
+}
+
+// enqueue hands a note over to the async workers, which are started on first
+// use. It blocks only if the queue of the workers is full.
+func (no *Notifier) enqueue(n *note) {
+	no.pool.Lock()
+	if no.pool.queue == nil {
+		capacity := no.Capacity()
+		if capacity < 1 {
+			capacity = 1
+		}
+		no.pool.queue = make(chan *note, capacity)
+		no.pool.progress = sync.NewCond(&no.pool.Mutex)
+		workers := no.pool.workers
+		if no.pool.ordered {
+			workers = 1
+		}
+		for i := 0; i < workers; i++ {
+			go no.forward(no.pool.queue)
+		}
+	}
+	queue := no.pool.queue
+	no.pool.queued++
+	no.pool.Unlock()
+
+	select {
+	case queue <- n:
+	case <-no.done:
+		no.route(n) // the workers have stopped
+	}
+}
+
+// forward routes the notes of the async worker queue until the notifier has
+// exited. Notes that are still queued are then refused by notifier.route.
+func (no *Notifier) forward(queue chan *note) {
+	for {
+		select {
+		case n := <-queue:
+			no.route(n)
+			no.pool.Lock()
+			no.pool.routed++
+			no.pool.progress.Broadcast()
+			no.pool.Unlock()
+		case <-no.done:
+			for {
+				select {
+				case n := <-queue:
+					no.route(n)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// drainPool waits until the async workers have routed as many notes as were
+// handed over to them so far. It reports false if expired fires first.
+func (no *Notifier) drainPool(expired <-chan time.Time) bool {
+	drained := make(chan struct{})
+	go func() {
+		no.pool.Lock()
+		for queued := no.pool.queued; no.pool.routed < queued; {
+			no.pool.progress.Wait()
+		}
+		no.pool.Unlock()
+		close(drained)
+	}()
 
-	args := []string{}
-	if len(a) > 0 {
-		args = []string{fmt.Sprintf(format, a...)}
-	} else {
-		args = []string{format}
+	select {
+	case <-drained:
+		return true
+	case <-expired:
+		return false
 	}
+}
 
-	if code < 0 {
-		syswarn(fmt.Sprintf("An error should have a non-zero code. Changing %d to 1", code))
-		code = 1
+// addFields adds fields to a note (and to all notes of a batch) without
+// replacing fields of the same key
+func addFields(n *note, fields map[string]interface{}) {
+	if len(fields) == 0 {
+		return
 	}
 
-	// Append some runtime information
-	if _, fn, line, ok := runtime.Caller(callerDepth); ok {
-		args = append(args, fmt.Sprintf(" -> [%s: %d]", filepath.Base(fn), line))
+	for _, b := range n.Batch {
+		addFields(b, fields)
 	}
 
-	return notification{code: code, message: strings.Join(args, " ")}
+	if n.Fields == nil {
+		n.Fields = make(map[string]interface{}, len(fields))
+	}
+	for key, value := range fields {
+		if _, set := n.Fields[key]; !set {
+			n.Fields[key] = value
+		}
+	}
 }
 
-// route puts the note into the note channel
-func route(sender string, value *interface{}, confirm chan<- bool, noteChan chan<- *note, ops *operations) {
-	ops.RLock()
-	if (*ops).halt != true {
-		noteChan <- &note{sender, *value, confirm}
-	} else {
-		confirm <- true
-		syswarn(sender + " cannot send to a closed channel")
-	}
-	ops.RUnlock()
+// isSent indicates whether a value is a notification returned by a send
+// function, which must not be sent twice
+func isSent(value interface{}) bool {
+	n, ok := value.(notification)
+	return ok && n.sent
+}
 
+// isHalted indicates if the notifier has stopped accepting notes
+func (no *Notifier) isHalted() bool {
+	no.ops.RLock()
+	defer no.ops.RUnlock()
+	return no.ops.halt
 }
 
-// send creates a note struct and sends it into the noteChan
-func send(sender string, value interface{}, confirm chan<- bool, noteChan chan<- *note, async bool, ops *operations) error {
+// send sends the note into the noteChan
+func (no *Notifier) send(n *note, async bool) error {
+
+	// Discard the note, but keep the returned error
+	if no.noop {
+		n.confirm()
+		if err, ok := n.Value.(error); ok {
+			return err
+		}
+		return nil
+	}
+
+	// Add ambient fields of the sender's goroutine
+	if no.fieldProvider != nil {
+		addFields(n, no.fieldProvider())
+	}
 
 	// Transfrom error to notification
-	_, ok1 := value.(notification)
-	_, ok2 := value.(error)
+	_, ok1 := n.Value.(notification)
+	_, ok2 := n.Value.(error)
 
 	if !ok1 && ok2 {
-		value = newf(1, 3, value.(error).Error())
+		n.Value = newf(errorCode(n.Value.(error)), 3, "%s", n.Value.(error).Error())
 	}
 
-	if async {
-		go route(sender, &value, confirm, noteChan, ops)
-	} else {
-		route(sender, &value, confirm, noteChan, ops)
+	// A halted notifier is reported synchronously even in async mode
+	if async && !no.isHalted() {
+		no.enqueue(n)
+	} else if err := no.route(n); err != nil {
+		return err
 	}
 
-	switch err := value.(type) {
+	switch err := n.Value.(type) {
 	case notification:
+		err.sent = true
 		return err
 	case error:
 		return err
@@ -177,19 +1084,56 @@ func send(sender string, value interface{}, confirm chan<- bool, noteChan chan<-
 	}
 }
 
-type logEntry struct {
-	Timestamp int    `json:"Timestamp"`
-	Service   string `json:"Service"`
-	Instance  string `json:"Instance"`
-	Sender    string `json:"Sender"`
-	Level     string `json:"Level"`
-	Code      int    `json:"Code"`
-	Status    string `json:"Status"`
-	Message   string `json:"Message"`
+// goroutineID returns the id of the calling goroutine, which is parsed from
+// the header of its stack trace ("goroutine 42 [running]:"). 0 is returned if
+// the header cannot be parsed.
+func goroutineID() int64 {
+	buf := make([]byte, 64)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		if id, err := strconv.ParseInt(string(buf[:i]), 10, 64); err == nil {
+			return id
+		}
+	}
+	return 0
+}
+
+// callerFunc returns the name of the function %skip% frames above the caller
+func callerFunc(skip int) string {
+	if pc, _, _, ok := runtime.Caller(skip + 1); ok {
+		if fn := runtime.FuncForPC(pc); fn != nil {
+			return fn.Name()
+		}
+	}
+	return ""
+}
+
+// callerFrames returns up to depth stack frames, starting %skip% frames above
+// the caller
+func callerFrames(skip int, depth int) []Frame {
+	pcs := make([]uintptr, depth)
+	n := runtime.Callers(skip+2, pcs)
+	if n == 0 {
+		return nil
+	}
+
+	frames := make([]Frame, 0, n)
+	callers := runtime.CallersFrames(pcs[:n])
+	for {
+		frame, more := callers.Next()
+		frames = append(frames, Frame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		if !more {
+			break
+		}
+	}
+	return frames
 }
 
-// correct corrects some possible mistakes in logEntry
-func (l *logEntry) correct() {
+// correct corrects some possible mistakes in LogEntry. Separators are only
+// replaced in text mode, since JSON is not delimited by them. Line breaks of
+// the message are handled according to the multiline mode.
+func (l *LogEntry) correct(text bool, multiline MultilineMode) {
 
 	// No empty strings
 	if l.Service == "" {
@@ -212,29 +1156,106 @@ func (l *logEntry) correct() {
 	}
 
 	// No tabs, newlines and so on.
-	for _, symbol := range []string{"\t", "\n", "\r", "\b", "\f", "\v"} {
+	if !text {
+		return
+	}
+	for _, symbol := range separators {
 		l.Service = strings.Replace(l.Service, symbol, " ", -1)
 		l.Instance = strings.Replace(l.Instance, symbol, " ", -1)
 		l.Sender = strings.Replace(l.Sender, symbol, " ", -1)
 		l.Level = strings.Replace(l.Level, symbol, " ", -1)
 		l.Status = strings.Replace(l.Status, symbol, " ", -1)
-		l.Message = strings.Replace(l.Message, symbol, " ", -1)
+		l.TraceID = strings.Replace(l.TraceID, symbol, " ", -1)
 	}
+	l.Message = formatMultiline(l.Message, multiline)
+
+}
 
+// formatMultiline replaces the separators of a text message according to the
+// multiline mode (see notifier.SetMultiline)
+func formatMultiline(message string, multiline MultilineMode) string {
+	switch multiline {
+	case MultilineEscape:
+		return multilineEscaper.Replace(message)
+	case MultilineIndent:
+		message = strings.Replace(message, "\r\n", "\n", -1)
+		for _, symbol := range separators {
+			if symbol != "\n" {
+				message = strings.Replace(message, symbol, " ", -1)
+			}
+		}
+		return strings.Replace(message, "\n", "\n\t", -1)
+	default:
+		for _, symbol := range separators {
+			message = strings.Replace(message, symbol, " ", -1)
+		}
+		return message
+	}
 }
 
-// toStr turns logEntry to string
-func (l *logEntry) toStr() string {
+// toStr turns LogEntry to string
+func (l *LogEntry) toStr() string {
 	return strconv.Itoa(l.Timestamp) + "\t" + l.Service + "\t" + l.Instance + "\t" + l.Sender + "\t" +
-		l.Level + "\t" + strconv.Itoa(l.Code) + "\t" + l.Status + "\t" + l.Message
+		l.Level + "\t" + strconv.Itoa(l.Code) + "\t" + l.Status + "\t" + l.messageStr()
 }
 
-// toJson turns logEntry to json-encoded string
-func (l *logEntry) toJson() string {
+// messageStr returns the message of a text entry. Structured fields, the trace
+// ID, the goroutine, the original code, the caller and the sequence number are
+// appended to the message as key=value pairs.
+func (l *LogEntry) messageStr() string {
+	message := l.Message
+	if len(l.Fields) > 0 {
+		message += " " + l.fieldsStr()
+	}
+	if l.TraceID != "" {
+		message += " trace_id=" + l.TraceID
+	}
+	if l.Goroutine != 0 {
+		message += " goroutine=" + strconv.FormatInt(l.Goroutine, 10)
+	}
+	if l.OrigCode != 0 {
+		message += " orig_code=" + strconv.Itoa(l.OrigCode)
+	}
+	if l.Caller != "" {
+		message += " caller=" + l.Caller
+	}
+	if l.Seq != 0 {
+		message += " seq=" + strconv.FormatInt(l.Seq, 10)
+	}
+	return message
+}
+
+// fieldsStr turns structured fields into space separated key=value pairs
+// (sorted by key)
+func (l *LogEntry) fieldsStr() string {
+	keys := make([]string, 0, len(l.Fields))
+	for key := range l.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		pairs[i] = fmt.Sprintf("%s=%v", key, l.Fields[key])
+		for _, symbol := range separators {
+			pairs[i] = strings.Replace(pairs[i], symbol, " ", -1)
+		}
+	}
+
+	return strings.Join(pairs, " ")
+}
+
+// toJson turns LogEntry to json-encoded string
+func (no *Notifier) toJson(l *LogEntry) string {
 	jsoned, err := json.Marshal(l)
 	if err != nil {
-		syswarn("Could not convert logEntry to JSON: " + err.Error())
-		return "{\"ERROR\": \"Could not convert logEntry to JSON\"}"
+		warning := "Could not convert LogEntry to JSON: " + err.Error()
+		if l.Code == 998 {
+			syswarn(warning) // do not log to avoid infinite loop
+		} else {
+			no.warn(warning)
+		}
+		return "{\"ERROR\": \"Could not convert LogEntry to JSON\"}"
 	}
 
 	return string(jsoned)
@@ -248,66 +1269,641 @@ func (l *logEntry) toJson() string {
 func (no *Notifier) log(n *note) {
 
 	// Confirm the log has been processed
-	if n.Confirm != nil {
-		defer func() { n.Confirm <- true }()
-	}
+	defer n.confirm()
 
 	// Sanity check (will panic)
 	no.isOK()
 
+	// Runtime panics must not kill notifier.Run()
+	var lg LogEntry
+	defer func() {
+		if r := recover(); r != nil {
+			no.recovered(r, lg)
+		}
+	}()
+
 	// Create a new log entry
-	lg := logEntry{
-		Timestamp: int(time.Now().Unix()),
+	lg = no.entry(n)
+	if (!n.Summary && no.suppressed(&lg)) || no.sampledOut(&lg) || no.digested(n, &lg) || no.quietLast(n) {
+		if n.Last {
+			no.flushBatch() // the backlog is written before the endpoints are closed
+			no.flushFiles()
+		}
+		return
+	}
+	no.countLevel(lg.Level)
+	if no.includeSeq {
+		lg.Seq = atomic.AddInt64(&no.seq, 1)
+	}
+	str := no.boundedFormat(&lg)
+
+	// Notify callbacks
+	defer no.logged(lg)
+
+	// Standard streams are written per entry, even if entries are batched. A
+	// failure is recorded once the endpoints have reported their writes.
+	if !no.writeStd(str, &lg) {
+		defer no.failedLine()
+	}
+
+	// Batch entries
+	if no.batchSize > 0 {
+		no.batch.buf = append(no.batch.buf, str...)
+		no.batch.count++
+		if no.batch.count >= no.batchSize || n.Last {
+			no.flushBatch()
+		}
+		return
+	}
+
+	no.writeAll(str, &lg)
+
+	// Synchronous senders wait until the entry is in the log files
+	if n.Confirm != nil {
+		no.flushFiles()
+	}
+}
+
+// quietLast indicates whether a note is the last note of notifier.Exit() and
+// is not logged (see notifier.SetQuietExit)
+func (no *Notifier) quietLast(n *note) bool {
+	return n.Last && no.quietExit && !n.Summary
+}
+
+// countLevel updates the counters of logged levels (see notifier.ErrorCount
+// and notifier.HighestLevelSeen)
+func (no *Notifier) countLevel(level string) {
+	no.stats.Lock()
+	defer no.stats.Unlock()
+
+	if level == "ERR" {
+		no.stats.Errors++
+	}
+	if no.stats.Levels == nil {
+		no.stats.Levels = make(map[string]int)
+	}
+	no.stats.Entries++
+	no.stats.Levels[level]++
+	if levelSeverity[level] > levelSeverity[no.stats.highest] {
+		no.stats.highest = level
+	}
+}
+
+// summary returns the structured fields of the exit summary (see
+// notifier.SetExitSummary)
+func (no *Notifier) summary() map[string]interface{} {
+	stats := no.Stats()
+
+	fields := map[string]interface{}{
+		"entries":        stats.Entries,
+		"duration":       no.now().Sub(no.started).String(),
+		"dropped":        stats.Dropped,
+		"write_failures": stats.WriteFailures,
+	}
+	for level, count := range stats.Levels {
+		fields[strings.ToLower(level)] = count
+	}
+	return fields
+}
+
+// logged calls the callbacks of logged entries (see notifier.OnLog). The
+// endpoints have to be locked by the caller.
+func (no *Notifier) logged(lg LogEntry) {
+	for _, fn := range no.onLog {
+		fn(lg)
+	}
+}
+
+// writeAll writes a log line (or a batch of lines) to all endpoints. The
+// endpoints have to be locked by the caller.
+func (no *Notifier) writeAll(str string, lg *LogEntry) {
+	written, failed := false, false
+	for i, w := range no.endpoints.endpointsPtr {
+		if no.splitOff(w) {
+			continue // written by notifier.writeStd
+		}
+		if no.writeEndpoint(i, w, str, lg) {
+			written = true
+		} else {
+			failed = true
+		}
+	}
+	if written {
+		atomic.StoreInt64(&no.lastWrite, no.now().UnixNano())
+	}
+
+	no.stats.Lock()
+	no.stats.lastFailed = failed
+	no.stats.Unlock()
+}
+
+// splitOff indicates whether an endpoint is skipped, because the standard
+// streams are written by notifier.writeStd instead (see StdSplitInstead)
+func (no *Notifier) splitOff(w io.Writer) bool {
+	return no.stdSplit == StdSplitInstead && (w == os.Stdout || w == os.Stderr)
+}
+
+// writeStd writes a log line to os.Stderr (level ERR) or os.Stdout (other
+// levels) if the notifier splits entries by level (see notifier.SetStdSplit).
+// It reports whether the line could be written.
+func (no *Notifier) writeStd(str string, lg *LogEntry) (ok bool) {
+	if no.stdSplit == StdSplitOff {
+		return true
+	}
+
+	w := os.Stdout
+	if lg.Level == "ERR" {
+		w = os.Stderr
+	}
+	if _, werr := io.WriteString(w, str); werr != nil {
+		no.stats.Lock()
+		no.stats.WriteFailures++
+		no.stats.Unlock()
+		return false
+	}
+	return true
+}
+
+// failedLine marks the latest log line as not written to all endpoints (see
+// notifier.Health)
+func (no *Notifier) failedLine() {
+	no.stats.Lock()
+	no.stats.lastFailed = true
+	no.stats.Unlock()
+}
+
+// flushBatch writes the batched entries to all endpoints. The endpoints have
+// to be locked by the caller.
+func (no *Notifier) flushBatch() {
+	if no.batch.count == 0 {
+		return
+	}
+
+	str := string(no.batch.buf)
+	lg := LogEntry{Service: no.service, Instance: no.instance, Sender: "notifier", Message: fmt.Sprintf("batch of %d entries", no.batch.count)}
+	no.batch.buf = no.batch.buf[:0]
+	no.batch.count = 0
+
+	no.writeAll(str, &lg)
+}
+
+// lockedLog logs a note (or all notes of a batch) while holding the endpoints
+// lock
+func (no *Notifier) lockedLog(n *note) {
+	no.endpoints.Lock()
+	defer no.endpoints.Unlock()
+
+	if n.Batch == nil {
+		no.log(n)
+		return
+	}
+
+	for _, b := range n.Batch {
+		no.log(b)
+	}
+	if n.Confirm != nil {
+		no.flushFiles()
+		n.confirm()
+	}
+}
+
+// suppressed indicates whether an entry is not logged, because it is a
+// message (level MSG) and the notifier does not log all notes (logAll), or
+// because its level is below the threshold (see notifier.SetMinLevel)
+func (no *Notifier) suppressed(lg *LogEntry) bool {
+	return !no.verbose(lg.Level)
+}
+
+// verbose indicates whether entries of a level are logged according to logAll
+// and the threshold of the notifier (see notifier.SetLogAll and
+// notifier.SetMinLevel)
+func (no *Notifier) verbose(level string) bool {
+	no.verbosity.RLock()
+	defer no.verbosity.RUnlock()
+
+	if level == "MSG" && !no.logAll {
+		return false
+	}
+	severity, ranked := levelSeverity[level]
+	return !ranked || severity >= levelSeverity[no.verbosity.minLevel]
+}
+
+// sampledOut indicates whether an entry is dropped by the sampler of its code
+func (no *Notifier) sampledOut(lg *LogEntry) bool {
+	s, ok := no.samplers[lg.Code]
+	if !ok {
+		return false
+	}
+
+	// First occurrence
+	now := no.now()
+	if s.start.IsZero() || now.Sub(s.start) >= s.window {
+		s.start = now
+		s.credit = 0
+		return false
+	}
+
+	s.credit += s.rate
+	if s.credit >= 1 {
+		s.credit--
+		return false
+	}
+
+	no.stats.Lock()
+	no.stats.Dropped++
+	no.stats.Unlock()
+	return true
+}
+
+// digested counts entries of digested codes instead of logging them
+func (no *Notifier) digested(n *note, lg *LogEntry) bool {
+	d, ok := no.digests[lg.Code]
+	if !ok || n.Digest {
+		return false
+	}
+
+	if d.count == 0 {
+		d.start = no.now()
+	}
+	d.count++
+	d.sender = lg.Sender
+	d.sample = lg.Message
+	return true
+}
+
+// flushDigests logs the digests whose interval has passed (or all pending
+// digests if all=true) and resets their counters
+func (no *Notifier) flushDigests(all bool) {
+	for code, d := range no.digests {
+		if d.count == 0 || (!all && no.now().Sub(d.start) < d.interval) {
+			continue
+		}
+
+		message := fmt.Sprintf("Code %d occurred %d times in the last %s (latest: %s)", code, d.count, d.interval, d.sample)
+		no.lockedLog(&note{Sender: d.sender, Value: notification{code: code, message: message}, Digest: true})
+		d.count = 0
+	}
+}
+
+// digestPeriod returns how often digests should be checked
+func (no *Notifier) digestPeriod() time.Duration {
+	period := time.Second
+	for _, d := range no.digests {
+		if d.interval < period {
+			period = d.interval
+		}
+	}
+	return period
+}
+
+// entry creates a corrected log entry from a note
+func (no *Notifier) entry(n *note) LogEntry {
+
+	now := no.now()
+	if no.utc {
+		now = now.UTC()
+	}
+
+	lg := LogEntry{
+		Timestamp: int(now.Unix()),
+		Time:      now,
 		Service:   no.service,
 		Instance:  no.instance,
 		Sender:    n.Sender,
+		Func:      n.Func,
+		Fields:    n.Fields,
+		Frames:    n.Frames,
+		TraceID:   n.TraceID,
+		Goroutine: n.Goroutine,
+	}
+	if no.senderNormalizer != nil {
+		lg.Sender = no.senderNormalizer(lg.Sender)
 	}
 
 	switch msg := (n.Value).(type) {
 
 	case notification:
 
-		if _, ok := no.notificationCodes[msg.code]; !ok {
+		if _, ok := no.codes()[msg.code]; !ok {
 			no.noteToSelf(newf(999, 1, "Unknown error code used. Replacing '%d' with '1'", msg.code))
 			lg.Code = 1
 		} else {
 			lg.Code = msg.code
 		}
 		lg.Message = msg.message
+		lg.Caller = msg.caller
+		if no.callerInfo != nil && lg.Caller != "" {
+			lg.Caller = no.callerInfo(lg.Caller)
+		}
 
 	case error:
-		lg.Code = 1
+		lg.Code = no.codeOf(msg)
 		lg.Message = msg.Error()
 
 	case string:
 		lg.Code = 0
 		lg.Message = msg
+		if no.parseLevelPrefix {
+			if code, stripped, ok := no.levelPrefix(msg); ok {
+				lg.Code = code
+				lg.Message = stripped
+			}
+		}
 
 	default:
 		lg.Code = 999
 		lg.Message = "Unknown value used in notify.send"
 	}
 
+	// Limit the length of messages and fields
+	if no.maxMessageLen > 0 {
+		lg.Message = truncateValue(lg.Message, no.maxMessageLen)
+		lg.Fields = truncateFields(lg.Fields, no.maxMessageLen)
+	}
+
+	// Remap codes
+	no.remap.RLock()
+	if code, ok := no.remap.codes[lg.Code]; ok {
+		lg.OrigCode = lg.Code
+		lg.Code = code
+	}
+	no.remap.RUnlock()
+
 	// Determine level and status
-	levelStatus, _ := no.notificationCodes[lg.Code]
+	levelStatus, _ := no.codes()[lg.Code]
 	lg.Level = levelStatus[0]
 	lg.Status = levelStatus[1]
 
 	// Correct entries
-	lg.correct()
+	lg.correct(!no.json, no.multiline)
+
+	return lg
+}
+
+// levelPrefix detects a level tag at the start of a message (e.g.
+// "[ERROR] disk full") and returns the code of the tag and the message without
+// the tag
+func (no *Notifier) levelPrefix(msg string) (int, string, bool) {
+	trimmed := strings.TrimLeft(msg, " ")
+	end := strings.IndexByte(trimmed, ']')
+	if !strings.HasPrefix(trimmed, "[") || end < 0 {
+		return 0, msg, false
+	}
+
+	prefixes := no.levelPrefixes
+	if prefixes == nil {
+		prefixes = defaultLevelPrefixes
+	}
+
+	code, ok := prefixes[strings.ToUpper(strings.TrimSpace(trimmed[1:end]))]
+	if _, known := no.codes()[code]; !ok || !known {
+		return 0, msg, false
+	}
+	return code, strings.TrimLeft(trimmed[end+1:], " "), true
+}
+
+// format turns a log entry into a log line (including the line break)
+func (no *Notifier) format(lg *LogEntry) string {
+	if no.formatter != nil {
+		if no.formatter.NeedsNewline() {
+			return no.formatter.Format(*lg) + "\n"
+		}
+		return no.formatter.Format(*lg)
+	}
 
-	// Write to all endpoints
-	var str string
 	if no.json {
-		str = lg.toJson()
-	} else {
-		str = lg.toStr()
+		return no.toJson(lg) + "\n"
 	}
+	return truncate(lg.toStr(), no.maxLineLen) + "\n"
+}
 
-	for i, w := range no.endpoints.endpointsPtr {
-		if _, werr := w.WriteString(str + "\n"); werr != nil {
-			syswarn("failed writing to " + strconv.Itoa(i+1) + "th endpoint: " + werr.Error()) // do not log to avoid infinite loop
+// boundedFormat formats a log entry within the format timeout (if set).
+// Formatting continues in the background after a timeout, but its result is
+// replaced by a fallback entry with a truncated message in the built-in format.
+func (no *Notifier) boundedFormat(lg *LogEntry) string {
+	if no.formatTimeout <= 0 {
+		return no.format(lg)
+	}
+
+	type formatted struct {
+		str       string
+		recovered interface{}
+	}
+
+	done := make(chan formatted, 1)
+	entry := *lg
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				done <- formatted{recovered: r}
+			}
+		}()
+		done <- formatted{str: no.format(&entry)}
+	}()
+
+	timer := time.NewTimer(no.formatTimeout)
+	defer timer.Stop()
+
+	select {
+	case f := <-done:
+		if f.recovered != nil {
+			panic(f.recovered) // recovered by notifier.log()
+		}
+		return f.str
+	case <-timer.C:
+		warning := "formatting an entry of " + lg.Sender + " timed out after " + no.formatTimeout.String()
+		if lg.Code == 998 {
+			syswarn(warning) // do not log to avoid infinite loop
+		} else {
+			no.warn(warning)
+		}
+	}
+
+	fallback := *lg
+	fallback.Message = truncate(fallback.Message, 256) + " (formatting timed out)"
+	if no.json {
+		return no.toJson(&fallback) + "\n"
+	}
+	return truncate(fallback.toStr(), no.maxLineLen) + "\n"
+}
+
+// truncate cuts a string to at most max bytes (without splitting UTF-8
+// characters) and marks the cut with an ellipsis. max <= 0 means no limit.
+func truncate(str string, max int) string {
+	if max <= 0 || len(str) <= max {
+		return str
+	}
+
+	const ellipsis = "..."
+	if max <= len(ellipsis) {
+		return ellipsis[:max]
+	}
+
+	cut := max - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(str[cut]) {
+		cut--
+	}
+	return str[:cut] + ellipsis
+}
+
+// truncateValue cuts a string to at most max bytes (without splitting UTF-8
+// characters) and appends the number of dropped bytes
+func truncateValue(str string, max int) string {
+	if len(str) <= max {
+		return str
+	}
+
+	cut := max
+	for cut > 0 && !utf8.RuneStart(str[cut]) {
+		cut--
+	}
+	return str[:cut] + "... (" + strconv.Itoa(len(str)-cut) + " bytes truncated)"
+}
+
+// truncateFields truncates the string values of structured fields. The fields
+// are copied if a value is truncated, since they may be shared with the sender.
+func truncateFields(fields map[string]interface{}, max int) map[string]interface{} {
+	copied := false
+	for key, value := range fields {
+		str, ok := value.(string)
+		if !ok || len(str) <= max {
+			continue
+		}
+
+		if !copied {
+			fields = copyFields(fields)
+			copied = true
+		}
+		fields[key] = truncateValue(str, max)
+	}
+	return fields
+}
+
+// copyFields returns a copy of structured fields
+func copyFields(fields map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(fields))
+	for key, value := range fields {
+		copied[key] = value
+	}
+	return copied
+}
+
+// dump writes a note to the fallback endpoint (os.Stderr if none is set)
+// instead of the endpoints. It is used once the exit grace period has expired.
+func (no *Notifier) dump(n *note) {
+	defer n.confirm()
+
+	if n.Batch != nil {
+		for _, b := range n.Batch {
+			no.dump(b)
 		}
+		return
 	}
 
+	// Batched entries precede the dumped notes
+	no.endpoints.Lock()
+	w := no.fallback
+	if w == nil {
+		w = os.Stderr
+	}
+	if no.batch.count > 0 {
+		if _, werr := w.Write(no.batch.buf); werr != nil {
+			syswarn("failed dumping batched entries: " + werr.Error())
+		}
+		no.batch.buf = no.batch.buf[:0]
+		no.batch.count = 0
+	}
+	no.endpoints.Unlock()
+
+	var lg LogEntry
+	defer func() {
+		if r := recover(); r != nil {
+			no.recovered(r, lg)
+		}
+	}()
+
+	lg = no.entry(n)
+	if _, werr := w.WriteString(no.format(&lg)); werr != nil {
+		syswarn("failed dumping a note: " + werr.Error())
+	}
+}
+
+// writeEndpoint writes a log line to an endpoint and reports whether it
+// succeeded. A panicking endpoint is reported, but does not prevent writing to
+// the remaining endpoints. Lines that could not be written are sent to the
+// fallback endpoint (without the delimiters of JSON arrays).
+func (no *Notifier) writeEndpoint(i int, w io.Writer, str string, lg *LogEntry) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			no.recovered(r, *lg)
+			no.writeFallback(w, str)
+			ok = false
+		}
+	}()
+
+	if _, werr := io.WriteString(w, no.arrayEntries(i, str)); werr != nil {
+		syswarn("failed writing to " + strconv.Itoa(i+1) + "th endpoint: " + werr.Error()) // do not log to avoid infinite loop
+		no.writeFallback(w, str)
+		return false
+	}
+	return true
+}
+
+// recovered passes a panic recovered while logging to the panic handler. By
+// default a code-999 entry is written to os.Stderr.
+func (no *Notifier) recovered(r interface{}, lg LogEntry) {
+
+	// The panic handler must not panic either
+	defer func() {
+		if r2 := recover(); r2 != nil {
+			warning := fmt.Sprintf("recovered from a panic in the panic handler: %v (original panic: %v)", r2, r)
+			if lg.Code == 998 {
+				syswarn(warning) // do not log to avoid infinite loop
+			} else {
+				no.warn(warning)
+			}
+		}
+	}()
+
+	if no.panicHandler != nil {
+		no.panicHandler(r, lg)
+		return
+	}
+
+	report := LogEntry{
+		Timestamp: int(no.now().Unix()),
+		Service:   no.service,
+		Instance:  no.instance,
+		Sender:    "notifier",
+		Code:      999,
+		Message:   fmt.Sprintf("Recovered from a panic while logging: %v (entry: %s)", r, lg.Message),
+	}
+	levelStatus := no.codes()[999]
+	report.Level = levelStatus[0]
+	report.Status = levelStatus[1]
+	report.correct(!no.json, MultilineFlatten)
+
+	// Built-in formats only, since the formatter might have caused the panic
+	line := report.toStr()
+	if no.json {
+		line = no.toJson(&report)
+	}
+	os.Stderr.WriteString(line + "\n")
+}
+
+// writeFallback counts a failed write and writes the log line to the fallback
+// endpoint (unless it is the failing endpoint itself). The endpoints have to be
+// locked by the caller.
+func (no *Notifier) writeFallback(failed io.Writer, str string) {
+	no.stats.Lock()
+	no.stats.WriteFailures++
+	no.stats.Unlock()
+
+	if no.fallback == nil || io.Writer(no.fallback) == failed {
+		return
+	}
+
+	if _, ferr := no.fallback.WriteString(str); ferr != nil {
+		syswarn("failed writing to the fallback endpoint: " + ferr.Error())
+	}
 }
@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogReader decodes the entries of a log written by a notifier (see
+// NewLogReader)
+type LogReader struct {
+	scanner    *bufio.Scanner
+	line       int    // Number of the latest scanned line
+	peeked     string // Line scanned ahead (see LogReader.scan)
+	peekedLine int    // Number of the peeked line (0: no line peeked)
+}
+
+// NewLogReader returns a reader of the log entries written by a notifier,
+// e.g. to a file endpoint. The format of each line (JSON or tab-separated
+// text) is detected automatically, header lines are skipped and JSON arrays
+// (see notifier.SetJSONArray) are unwrapped. In text mode, structured fields
+// and other key=value pairs appended to the message remain part of the
+// message, and continuation lines of multi-line messages (see
+// MultilineIndent) are joined.
+func NewLogReader(r io.Reader) *LogReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &LogReader{scanner: scanner}
+}
+
+// Next returns the next entry of the log. Empty lines are skipped. io.EOF is
+// returned at the end of the log. A malformed line is reported with its line
+// number; the following entries can still be read.
+func (lr *LogReader) Next() (LogEntry, error) {
+	for {
+		line, number, ok := lr.scan()
+		if !ok {
+			break
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, `{"Header":"`+fileHeaderName+`"`) {
+			continue // empty lines and headers (see notifier.SetFileHeader)
+		}
+		if trimmed := strings.TrimSpace(line); trimmed == "[" || trimmed == "]" || trimmed == "[]" {
+			continue // delimiters of JSON arrays (see notifier.SetJSONArray)
+		}
+
+		var entry LogEntry
+		var err error
+		if strings.HasPrefix(line, "{") {
+			err = json.Unmarshal([]byte(strings.TrimSuffix(line, ",")), &entry)
+		} else {
+			entry, err = parseTextEntry(lr.continued(line))
+		}
+		if err != nil {
+			return LogEntry{}, fmt.Errorf("notify: malformed log entry in line %d: %s", number, err.Error())
+		}
+
+		entry.Time = time.Unix(int64(entry.Timestamp), 0)
+		return entry, nil
+	}
+
+	if err := lr.scanner.Err(); err != nil {
+		return LogEntry{}, err
+	}
+	return LogEntry{}, io.EOF
+}
+
+// scan returns the next line of the log and its number
+func (lr *LogReader) scan() (string, int, bool) {
+	if lr.peekedLine > 0 {
+		line, number := lr.peeked, lr.peekedLine
+		lr.peekedLine = 0
+		return line, number, true
+	}
+
+	if !lr.scanner.Scan() {
+		return "", 0, false
+	}
+	lr.line++
+	return strings.TrimRight(lr.scanner.Text(), "\r"), lr.line, true
+}
+
+// continued joins a text line with its continuation lines, which start with a
+// tab (see MultilineIndent)
+func (lr *LogReader) continued(line string) string {
+	for {
+		next, number, ok := lr.scan()
+		if !ok {
+			return line
+		}
+		if !strings.HasPrefix(next, "\t") {
+			lr.peeked, lr.peekedLine = next, number
+			return line
+		}
+		line += "\n" + next[1:]
+	}
+}
+
+// parseTextEntry parses a tab-separated log line with 8 fields (see
+// notifier.log)
+func parseTextEntry(line string) (LogEntry, error) {
+	fields := strings.SplitN(line, "\t", 8)
+	if len(fields) != 8 {
+		return LogEntry{}, fmt.Errorf("expected 8 tab-separated fields, got %d", len(fields))
+	}
+
+	timestamp, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid timestamp '%s'", fields[0])
+	}
+	code, err := strconv.Atoi(fields[5])
+	if err != nil {
+		return LogEntry{}, fmt.Errorf("invalid code '%s'", fields[5])
+	}
+
+	return LogEntry{
+		Timestamp: timestamp,
+		Service:   fields[1],
+		Instance:  fields[2],
+		Sender:    fields[3],
+		Level:     fields[4],
+		Code:      code,
+		Status:    fields[6],
+		Message:   fields[7],
+	}, nil
+}
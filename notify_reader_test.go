@@ -0,0 +1,71 @@
+package notify
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogReader(t *testing.T) {
+
+	for _, json := range []bool{false, true} {
+
+		logfile := os.Getenv("HOME") + "/TestLogReader.log"
+
+		notifier := NewNotifier("MyService", "MyServiceInstance", true, false, json, 100, logfile)
+		go notifier.Run()
+		notifier.WarmUp()
+		notifier.Sender("TestLogReader")("Hello, World!")
+		notifier.Failure("TestLogReader")(404, "Page not found")
+		notifier.Exit()
+
+		f, err := os.Open(logfile)
+		if err != nil {
+			t.Fatal("Failed opening the log file: " + err.Error())
+		}
+
+		reader := NewLogReader(f)
+		entries := []LogEntry{}
+		for {
+			entry, rerr := reader.Next()
+			if rerr == io.EOF {
+				break
+			} else if rerr != nil {
+				t.Fatal("Failed reading the log: " + rerr.Error())
+			}
+			entries = append(entries, entry)
+		}
+		f.Close()
+		os.Remove(logfile)
+
+		if len(entries) != 3 {
+			t.Fatalf("Expected 3 entries (json: %t), got %d", json, len(entries))
+		}
+		if e := entries[0]; e.Service != "MyService" || e.Sender != "TestLogReader" || e.Code != 0 || e.Message != "Hello, World!" || e.Time.IsZero() {
+			t.Errorf("Unexpected entry (json: %t): %v", json, e)
+		}
+		if e := entries[1]; e.Level != "ERR" || e.Code != 404 || e.Status != "HTTP-StatusNotFound" || !strings.HasPrefix(e.Message, "Page not found") {
+			t.Errorf("Unexpected entry (json: %t): %v", json, e)
+		}
+	}
+
+	multiline := NewLogReader(strings.NewReader("1481552048\ts\ti\tsender\tERR\t1\tGeneralError\tpanic: boom\n\tmain.go:42\n1481552049\ts\ti\tsender\tMSG\t0\tGeneralMessage\tdone\n"))
+	if entry, err := multiline.Next(); err != nil || entry.Message != "panic: boom\nmain.go:42" {
+		t.Errorf("Continuation lines should be joined, got %q (%v)", entry.Message, err)
+	}
+	if entry, err := multiline.Next(); err != nil || entry.Message != "done" {
+		t.Errorf("The entry after a multi-line entry should be readable, got %q (%v)", entry.Message, err)
+	}
+
+	reader := NewLogReader(strings.NewReader("not an entry\n\n1481552048\ts\ti\tsender\tMSG\t0\tGeneralMessage\tHello\n"))
+	if _, err := reader.Next(); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Errorf("Expected an error about line 1, got %v", err)
+	}
+	if entry, err := reader.Next(); err != nil || entry.Message != "Hello" {
+		t.Errorf("Entries after a malformed line should be readable, got %v (%v)", entry, err)
+	}
+	if _, err := reader.Next(); err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
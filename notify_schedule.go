@@ -0,0 +1,134 @@
+package notify
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// schedule is a minimal cron schedule ("minute hour day-of-month month
+// day-of-week"). Fields accept *, numbers, ranges (1-5), steps (*/15, 0-30/10)
+// and comma separated lists.
+type schedule struct {
+	minute, hour, dom, month, dow map[int]bool
+	domAny, dowAny                bool // Unrestricted days (see schedule.matches)
+}
+
+// scheduleShortcuts are the supported cron shortcuts
+var scheduleShortcuts = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+}
+
+// parseSchedule parses a cron spec or one of the shortcuts @hourly, @daily,
+// @midnight, @weekly and @monthly
+func parseSchedule(spec string) (*schedule, error) {
+	spec = strings.TrimSpace(spec)
+	if expanded, ok := scheduleShortcuts[spec]; ok {
+		spec = expanded
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("schedule '" + spec + "' does not have 5 fields")
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 6}}
+	sets := make([]map[int]bool, 5)
+	for i, field := range fields {
+		set, err := parseScheduleField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, errors.New("schedule '" + spec + "': " + err.Error())
+		}
+		sets[i] = set
+	}
+
+	return &schedule{
+		minute: sets[0],
+		hour:   sets[1],
+		dom:    sets[2],
+		month:  sets[3],
+		dow:    sets[4],
+		domAny: fields[2] == "*",
+		dowAny: fields[4] == "*",
+	}, nil
+}
+
+// parseScheduleField returns the values matched by a field of a cron spec
+func parseScheduleField(field string, min int, max int) (map[int]bool, error) {
+	set := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			s, err := strconv.Atoi(part[i+1:])
+			if err != nil || s <= 0 {
+				return nil, errors.New("invalid step in '" + part + "'")
+			}
+			step = s
+			part = part[:i]
+		}
+
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			f, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.New("invalid value '" + part + "'")
+			}
+			from, to = f, f
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("invalid range '" + part + "'")
+				}
+			} else if step > 1 {
+				to = max // e.g. 5/15
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return nil, errors.New("'" + part + "' is out of range " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+
+	return set, nil
+}
+
+// matches indicates whether the schedule matches a minute. Like cron, a day
+// matches either restricted day field if both are restricted.
+func (s *schedule) matches(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+
+	dom, dow := s.dom[t.Day()], s.dow[int(t.Weekday())]
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first scheduled time after t (zero if there is none within
+// five years, e.g. February 31st)
+func (s *schedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	for end := t.AddDate(5, 0, 0); t.Before(end); t = t.Add(time.Minute) {
+		if s.matches(t) {
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,161 @@
+package notify
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+
+	start := time.Date(2017, 1, 1, 12, 30, 0, 0, time.UTC) // Sunday
+
+	tests := []struct {
+		spec string
+		next time.Time
+	}{
+		{"@hourly", time.Date(2017, 1, 1, 13, 0, 0, 0, time.UTC)},
+		{"*/20 * * * *", time.Date(2017, 1, 1, 12, 40, 0, 0, time.UTC)},
+		{"15,45 9-17 * * *", time.Date(2017, 1, 1, 12, 45, 0, 0, time.UTC)},
+		{"0 0 * * 3", time.Date(2017, 1, 4, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * *", time.Date(2017, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, test := range tests {
+		s, err := parseSchedule(test.spec)
+		if err != nil {
+			t.Errorf("Failed parsing '%s': %s", test.spec, err.Error())
+			continue
+		}
+		if next := s.next(start); !next.Equal(test.next) {
+			t.Errorf("Expected '%s' to be next scheduled at %v, got %v", test.spec, test.next, next)
+		}
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "a * * * *", "5-1 * * * *"} {
+		if _, err := parseSchedule(spec); err == nil {
+			t.Errorf("Parsing '%s' should fail", spec)
+		}
+	}
+}
+
+func TestRotationSchedule(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestRotationSchedule.log"
+	defer os.Remove(logfile)
+
+	clock := time.Date(2017, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	notifier.SetClock(func() time.Time { return clock })
+	if err := notifier.SetRotationSchedule("0 0 31 2 *"); err == nil {
+		t.Error("A schedule that never occurs should be rejected")
+	}
+	if err := notifier.SetRotationSchedule("@hourly"); err != nil {
+		t.Fatal("Failed setting the rotation schedule: " + err.Error())
+	}
+
+	// Set up like notifier.Run(), which checks the schedule every second
+	notifier.nextRotation = notifier.rotation.next(clock)
+	log := func(message string) {
+		notifier.lockedLog(&note{Sender: "TestRotationSchedule", Value: message})
+	}
+
+	rotated := []string{}
+	for _, step := range []struct {
+		clock   time.Time
+		rotated string
+	}{
+		{time.Date(2017, 1, 1, 12, 59, 59, 0, time.UTC), ""},
+		{time.Date(2017, 1, 1, 13, 0, 0, 0, time.UTC), ".20170101-130000"},
+		{time.Date(2017, 1, 1, 13, 30, 0, 0, time.UTC), ""},
+		{time.Date(2017, 1, 1, 14, 0, 1, 0, time.UTC), ".20170101-140000"},
+	} {
+		log("before " + step.clock.Format("15:04:05"))
+		clock = step.clock
+		notifier.rotateIfDue()
+
+		if step.rotated != "" {
+			rotated = append(rotated, logfile+step.rotated)
+			defer os.Remove(logfile + step.rotated)
+		}
+	}
+	log("current")
+	notifier.Exit()
+
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotations, got %d", len(rotated))
+	}
+	if lines := readLogLines(t, rotated[0]); len(lines) != 2 || !strings.HasSuffix(lines[1], "before 13:00:00") {
+		t.Errorf("Unexpected entries in the first rotated file: %v", lines)
+	}
+	if lines := readLogLines(t, rotated[1]); len(lines) != 2 || !strings.HasSuffix(lines[1], "before 14:00:01") {
+		t.Errorf("Unexpected entries in the second rotated file: %v", lines)
+	}
+	if lines := readLogLines(t, logfile); len(lines) != 1 || !strings.HasSuffix(lines[0], "current") {
+		t.Errorf("Unexpected entries in the current file: %v", lines)
+	}
+}
+
+func TestCompressRotated(t *testing.T) {
+
+	dir := os.Getenv("HOME") + "/TestCompressRotated"
+	logfile := dir + "/TestCompressRotated.log"
+	defer os.RemoveAll(dir)
+
+	// Files that are not backups of the log file are kept
+	others := []string{"TestCompressRotated.log.1.20170101-100000.gz", "TestCompressRotated.log.old.gz"}
+	os.MkdirAll(dir, 0700)
+	for _, other := range others {
+		if err := ioutil.WriteFile(dir+"/"+other, nil, 0600); err != nil {
+			t.Fatal("Failed creating " + other + ": " + err.Error())
+		}
+	}
+
+	clock := time.Date(2017, 1, 1, 12, 30, 0, 0, time.UTC)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	notifier.SetClock(func() time.Time { return clock })
+	notifier.SetRotationSchedule("@hourly")
+	if err := notifier.SetCompressRotated(true, 2); err != nil {
+		t.Fatal("Failed enabling compression: " + err.Error())
+	}
+
+	notifier.nextRotation = notifier.rotation.next(clock)
+	for hour := 13; hour <= 15; hour++ {
+		notifier.lockedLog(&note{Sender: "TestCompressRotated", Value: "before " + strconv.Itoa(hour)})
+		clock = time.Date(2017, 1, 1, hour, 0, 0, 0, time.UTC)
+		notifier.rotateIfDue()
+	}
+	notifier.Exit()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal("Failed listing the log directory: " + err.Error())
+	}
+	names := []string{}
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	expected := []string{"TestCompressRotated.log", others[0], "TestCompressRotated.log.20170101-140000.gz", "TestCompressRotated.log.20170101-150000.gz", others[1]}
+	if strings.Join(names, ",") != strings.Join(expected, ",") {
+		t.Fatalf("Expected files %v, got %v", expected, names)
+	}
+
+	f, err := os.Open(dir + "/" + expected[3])
+	if err != nil {
+		t.Fatal("Failed opening the compressed backup: " + err.Error())
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal("The backup is not compressed: " + err.Error())
+	}
+	if content, _ := ioutil.ReadAll(gz); !strings.HasSuffix(strings.TrimSpace(string(content)), "before 15") {
+		t.Errorf("Unexpected content of the compressed backup: '%s'", content)
+	}
+}
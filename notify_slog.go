@@ -0,0 +1,130 @@
+package notify
+
+import (
+	"context"
+	"log/slog"
+	"runtime"
+)
+
+// slogHandler is a slog.Handler sending records as notes of a sender
+type slogHandler struct {
+	no     *Notifier
+	sender string
+	fields map[string]interface{} // Attributes added by WithAttrs
+	prefix string                 // Group of the attributes, e.g. "request."
+}
+
+// SlogHandler returns a slog.Handler backed by the notifier, e.g.
+// slog.New(notifier.SlogHandler("sender")). Records of level slog.LevelError
+// and above are logged as errors (code 1), records of level slog.LevelWarn as
+// warnings (code 5) and all other records as messages (code 0). Attributes
+// are logged as structured fields, qualified by their groups (e.g.
+// "request.id").
+func (no *Notifier) SlogHandler(sender string) slog.Handler {
+	return &slogHandler{no: no, sender: sender}
+}
+
+// Enabled reports whether records of the level are logged. Messages are only
+// logged if the notifier logs all notes (logAll). Records below the threshold
+// of the notifier (see notifier.SetMinLevel) are not logged either.
+func (h *slogHandler) Enabled(_ context.Context, level slog.Level) bool {
+	if h.no.noop {
+		return false
+	}
+
+	switch {
+	case level >= slog.LevelError:
+		return h.no.verbose("ERR")
+	case level >= slog.LevelWarn:
+		return h.no.verbose("WRN")
+	default:
+		return h.no.verbose("MSG")
+	}
+}
+
+// Handle sends the record to the notifier. Only ErrNotifierClosed is returned.
+func (h *slogHandler) Handle(_ context.Context, r slog.Record) error {
+
+	var value interface{} = r.Message
+	switch {
+	case r.Level >= slog.LevelError:
+		value = notification{code: 1, message: r.Message}
+	case r.Level >= slog.LevelWarn:
+		value = notification{code: 5, message: r.Message}
+	}
+
+	n := &note{Sender: h.sender, Value: value}
+	if h.no.includeFunc && r.PC != 0 {
+		if fn := runtime.FuncForPC(r.PC); fn != nil {
+			n.Func = fn.Name()
+		}
+	}
+	if h.no.includeGoroutine {
+		n.Goroutine = goroutineID()
+	}
+
+	if len(h.fields) > 0 || r.NumAttrs() > 0 {
+		n.Fields = make(map[string]interface{}, len(h.fields)+r.NumAttrs())
+		for key, value := range h.fields {
+			n.Fields[key] = value
+		}
+		r.Attrs(func(a slog.Attr) bool {
+			addSlogAttr(n.Fields, h.prefix, a)
+			return true
+		})
+	}
+
+	if err := h.no.send(n, h.no.async); err == ErrNotifierClosed {
+		return err
+	}
+	return nil
+}
+
+// WithAttrs returns a handler logging the attributes with every record
+func (h *slogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	if len(attrs) == 0 {
+		return h
+	}
+
+	h2 := *h
+	h2.fields = make(map[string]interface{}, len(h.fields)+len(attrs))
+	for key, value := range h.fields {
+		h2.fields[key] = value
+	}
+	for _, a := range attrs {
+		addSlogAttr(h2.fields, h.prefix, a)
+	}
+	return &h2
+}
+
+// WithGroup returns a handler qualifying subsequent attributes by the group
+func (h *slogHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	h2 := *h
+	h2.prefix = h.prefix + name + "."
+	return &h2
+}
+
+// addSlogAttr adds an attribute to the fields, flattening groups
+func addSlogAttr(fields map[string]interface{}, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+
+	if a.Value.Kind() == slog.KindGroup {
+		groupPrefix := prefix
+		if a.Key != "" {
+			groupPrefix = prefix + a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			addSlogAttr(fields, groupPrefix, ga)
+		}
+		return
+	}
+
+	fields[prefix+a.Key] = a.Value.Any()
+}
@@ -0,0 +1,69 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"testing"
+)
+
+func TestSlogHandler(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestSlogHandler.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	logger := slog.New(notifier.SlogHandler("TestSlogHandler")).With("service", "api").WithGroup("request")
+	logger.Info("Hello, World!", "id", 7, slog.Group("user", "name", "gopher"))
+	logger.Error("Something failed", "retry", true)
+	logger.Warn("Be careful")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 log lines, got %d", len(lines))
+	}
+
+	info := LogEntry{}
+	if errJson := json.Unmarshal([]byte(lines[0]), &info); errJson != nil {
+		t.Fatal("Failed unmarshaling log entry")
+	}
+	if info.Code != 0 || info.Message != "Hello, World!" || info.Sender != "TestSlogHandler" {
+		t.Errorf("Unexpected entry: %v", info)
+	}
+	if info.Fields["service"] != "api" || info.Fields["request.id"] != float64(7) || info.Fields["request.user.name"] != "gopher" {
+		t.Errorf("Unexpected fields: %v", info.Fields)
+	}
+
+	failure := LogEntry{}
+	if errJson := json.Unmarshal([]byte(lines[1]), &failure); errJson != nil {
+		t.Fatal("Failed unmarshaling log entry")
+	}
+	if failure.Code != 1 || failure.Message != "Something failed" || failure.Fields["request.retry"] != true {
+		t.Errorf("Unexpected entry: %v", failure)
+	}
+
+	warning := LogEntry{}
+	if errJson := json.Unmarshal([]byte(lines[2]), &warning); errJson != nil {
+		t.Fatal("Failed unmarshaling log entry")
+	}
+	if warning.Code != 5 || warning.Level != "WRN" {
+		t.Errorf("Unexpected entry: %v", warning)
+	}
+
+	// Messages are only enabled if the notifier logs all notes
+	quiet := NewNotifier("MyService", "MyServiceInstance", false, false, true, 100, logfile)
+	handler := quiet.SlogHandler("TestSlogHandler")
+	if handler.Enabled(context.Background(), slog.LevelInfo) || !handler.Enabled(context.Background(), slog.LevelWarn) {
+		t.Error("Levels are not enabled according to logAll")
+	}
+	quiet.SetMinLevel("ERR")
+	if handler.Enabled(context.Background(), slog.LevelWarn) || !handler.Enabled(context.Background(), slog.LevelError) {
+		t.Error("Levels are not enabled according to the threshold")
+	}
+	quiet.Exit()
+}
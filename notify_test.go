@@ -1,15 +1,19 @@
 package notify
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -54,8 +58,15 @@ func TestNotify(t *testing.T) {
 	// Run the secondary notification service in the background to avoid blocking
 	go noSecond.Run()
 
+	// Senders must not outlive the test: their warnings about the closed
+	// notifier would end up in the internal warning sink of other tests
+	var senders sync.WaitGroup
+	defer senders.Wait()
+
 	// Write arbitrary messages and error logs
+	senders.Add(1)
 	go func() {
+		defer senders.Done()
 
 		send := noPrime.Sender("MyGoRoutine")  // personalized plain message sender
 		fail := noPrime.Failure("MyGoRoutine") // personalized notification sender
@@ -63,14 +74,18 @@ func TestNotify(t *testing.T) {
 		send("MyGoRoutine will start logging now!") // will log a GeneralMessage
 		for i := 1; i <= 100; i++ {
 
+			var err error
 			if i%2 == 0 {
 				if i%3 == 0 {
-					send(errors.New(strconv.Itoa(i) + "th iteration: something bad happened")) // will log (and return) an error with code=1
+					err = send(errors.New(strconv.Itoa(i) + "th iteration: something bad happened")) // will log (and return) an error with code=1
 				} else {
-					fail(3, strconv.Itoa(i)+"th iteration: something bad happened") // will log (and return) an error with code=3
+					err = fail(3, strconv.Itoa(i)+"th iteration: something bad happened") // will log (and return) an error with code=3
 				}
 			} else {
-				send(strconv.Itoa(i) + "th iteration: nothing bad happened") // will log a message
+				err = send(strconv.Itoa(i) + "th iteration: nothing bad happened") // will log a message
+			}
+			if err == ErrNotifierClosed {
+				return // the main notifier has exited
 			}
 
 			time.Sleep(500 * time.Millisecond)
@@ -97,7 +112,9 @@ func TestNotify(t *testing.T) {
 	}()
 
 	// Try to send to a closed notifier after 6 seconds
+	senders.Add(1)
 	go func() {
+		defer senders.Done()
 		<-time.After(6 * time.Second)
 		sendToMain("Are you still there?") // will not be sent
 	}()
@@ -149,9 +166,7 @@ func TestSetCodes(t *testing.T) {
 		notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100)
 		if i == 3 {
 			go notifier.Run()
-			for !notifier.isReady() {
-				// wait for start
-			}
+			notifier.WarmUp()
 		}
 		if err := notifier.SetCodes(test.newCodes); (err != nil) != test.err {
 			if err != nil {
@@ -163,6 +178,260 @@ func TestSetCodes(t *testing.T) {
 	}
 }
 
+func TestSetCodesValidation(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+	err := notifier.SetCodes(map[int][2]string{
+		1:  {"ERR", "Woopsie"},
+		42: {"EROR", "Typo"},
+		43: {"ERR", " "},
+		44: {"WRN", "Fine"},
+	})
+
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed replacing 3 status codes: invalid range (codes 1); unknown level or empty status (codes 42, 43)") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if _, ok := notifier.notificationCodes[42]; ok || notifier.notificationCodes[44][1] != "Fine" {
+		t.Error("Only valid codes should be replaced")
+	}
+
+	RegisterLevel("DBG")
+	if err := notifier.SetCodes(map[int][2]string{45: {"DBG", "Debugging"}}); err != nil {
+		t.Error("A registered level should be accepted: " + err.Error())
+	}
+}
+
+func TestSetMaxCode(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	logfile := os.Getenv("HOME") + "/TestSetMaxCode.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if err := notifier.SetCodes(map[int][2]string{5000: {"ERR", "RegistryError"}}); err == nil {
+		t.Error("Codes above 999 should not be replaceable by default")
+	}
+	if err := notifier.SetMaxCode(500); err == nil {
+		t.Error("The maximum code should not be lower than 999")
+	}
+	if err := notifier.SetMaxCode(10000); err != nil {
+		t.Fatal("Failed setting the maximum code: " + err.Error())
+	}
+	if err := notifier.SetCodes(map[int][2]string{5000: {"ERR", "RegistryError"}}); err != nil {
+		t.Error("Failed replacing code 5000: " + err.Error())
+	}
+	if err := notifier.SetCodes(map[int][2]string{999: {"ERR", "TotalFailure"}}); err == nil {
+		t.Error("Code 999 should stay reserved")
+	}
+	if err := notifier.SetCodes(map[int][2]string{998: {"WRN", "Warning"}}); err == nil {
+		t.Error("Code 998 should stay reserved")
+	}
+	if _, ok := standardCodes[5000]; ok {
+		t.Error("Standard codes should not be modified")
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Failure("TestSetMaxCode")(5000, "Registry entry is missing")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if fields := strings.Split(lines[len(lines)-2], "\t"); fields[5] != "5000" || fields[6] != "RegistryError" {
+		t.Errorf("Unexpected entry: %v", fields)
+	}
+}
+
+func TestDeleteCode(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100)
+	notifier.SetCodes(map[int][2]string{42: {"ERR", "Custom"}})
+
+	if err := notifier.DeleteCode(42); err != nil {
+		t.Error("Failed deleting a custom code: " + err.Error())
+	}
+	if _, ok := notifier.notificationCodes[42]; ok {
+		t.Error("Code 42 was not deleted")
+	}
+	if err := notifier.DeleteCode(42); err == nil {
+		t.Error("Deleting an unknown code should fail")
+	}
+	for _, code := range []int{0, 1, 998, 999} {
+		if err := notifier.DeleteCode(code); err == nil {
+			t.Errorf("Deleting the system code %d should fail", code)
+		}
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.DeleteCode(404); err == nil {
+		t.Error("Deleting codes of a running notifier should fail")
+	}
+	notifier.Exit()
+}
+
+func TestSetCodesWithBacklog(t *testing.T) {
+
+	var warnings bytes.Buffer
+	SetInternalWarnWriter(&warnings)
+	defer SetInternalWarnWriter(os.Stderr)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+	notifier.SetCodes(map[int][2]string{42: {"ERR", "Custom"}})
+	if warnings.Len() > 0 {
+		t.Errorf("Unexpected warning: '%s'", warnings.String())
+	}
+
+	notifier.Failure("TestSetCodesWithBacklog")(42, "Queued")
+	notifier.SetCodes(map[int][2]string{42: {"ERR", "Changed"}})
+	if !strings.Contains(warnings.String(), "while 1 notes are queued") {
+		t.Errorf("Expected a warning about queued notes, got '%s'", warnings.String())
+	}
+}
+
+func TestCodesIsolation(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier1 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100)
+	notifier2 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100)
+
+	notifier1.SetCodes(map[int][2]string{42: {"ERR", "Custom"}, 404: {"ERR", "Missing"}})
+	notifier3 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100)
+
+	for i, notifier := range []*Notifier{notifier2, notifier3} {
+		if _, ok := notifier.notificationCodes[42]; ok || notifier.notificationCodes[404][1] != "HTTP-StatusNotFound" {
+			t.Errorf("Custom codes leaked into notifier %d", i+2)
+		}
+	}
+	if notifier1.notificationCodes[404][1] != "Missing" {
+		t.Error("Custom codes were not set")
+	}
+}
+
+func TestResetCodes(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier1 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100)
+	notifier1.SetCodes(map[int][2]string{42: {"ERR", "Custom"}, 404: {"ERR", "Missing"}})
+
+	if err := notifier1.ResetCodes(); err != nil {
+		t.Error("Failed resetting codes: " + err.Error())
+	}
+	if _, ok := notifier1.notificationCodes[42]; ok || notifier1.notificationCodes[404][1] != "HTTP-StatusNotFound" {
+		t.Error("Codes were not reset")
+	}
+}
+
+func TestLoadCodes(t *testing.T) {
+
+	codesfile := os.Getenv("HOME") + "/TestLoadCodes.json"
+	defer os.Remove(codesfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+	defer notifier.Exit()
+
+	if err := notifier.LoadCodes(codesfile); !IsCode(3, err) {
+		t.Errorf("A missing file should be reported as a failed action, got %v", err)
+	}
+
+	for content, valid := range map[string]bool{
+		`{"404": {"level": "ERR", "status": "NotFound"}, "42": {"level": "MSG", "status": "Answer"}}`: true,
+		`{"404": ["ERR", "NotFound"]}`:                     false,
+		`{"four": {"level": "ERR", "status": "NotFound"}}`: false,
+		`{"43": {"level": "BAD", "status": "Bad"}}`:        false,
+	} {
+		if err := ioutil.WriteFile(codesfile, []byte(content), 0600); err != nil {
+			t.Fatal("Failed writing the codes file: " + err.Error())
+		}
+		if err := notifier.LoadCodes(codesfile); (err == nil) != valid {
+			t.Errorf("Unexpected result of loading '%s': %v", content, err)
+		}
+	}
+
+	if notifier.notificationCodes[404] != [2]string{"ERR", "NotFound"} || notifier.notificationCodes[42] != [2]string{"MSG", "Answer"} {
+		t.Error("Codes were not loaded")
+	}
+	if _, ok := notifier.notificationCodes[43]; ok {
+		t.Error("Invalid codes should not be loaded")
+	}
+
+	// Codes are reloaded on a running notifier
+	statuses := make(chan string, 10)
+	notifier.OnLog(func(entry LogEntry) { statuses <- entry.Status })
+	go notifier.Run()
+	notifier.WarmUp()
+
+	if err := ioutil.WriteFile(codesfile, []byte(`{"42": {"level": "ERR", "status": "Reloaded"}}`), 0600); err != nil {
+		t.Fatal("Failed writing the codes file: " + err.Error())
+	}
+	if err := notifier.LoadCodes(codesfile); err != nil {
+		t.Error("Failed reloading codes on a running notifier: " + err.Error())
+	}
+	if err := notifier.Failure("TestLoadCodes")(42, "Reloaded code"); !notifier.IsStatus("Reloaded", err) {
+		t.Errorf("Expected the reloaded status of code 42, got %v", err)
+	}
+	notifier.Exit()
+
+	reloaded := false
+	for len(statuses) > 0 {
+		if <-statuses == "Reloaded" {
+			reloaded = true
+		}
+	}
+	if !reloaded {
+		t.Error("Expected the entry to be logged with the reloaded code")
+	}
+	if !notifier.IsLevel("ERR", newf(404, 1, "Not found")) {
+		t.Error("Codes missing from the reloaded file should be kept")
+	}
+}
+
+func TestCodeRemap(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestCodeRemap.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	if err := notifier.SetCodeRemap(map[int]int{3: 4242, 999: 10}); err == nil {
+		t.Error("Remapping to unknown and from internal codes should fail")
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	fail := notifier.Failure("TestCodeRemap")
+	if err := notifier.SetCodeRemap(map[int]int{3: 10}); err != nil {
+		t.Fatal("Failed remapping codes of a running notifier: " + err.Error())
+	}
+	fail(3, "remapped")
+	fail(4, "not remapped")
+	notifier.SendSync("TestCodeRemap", "flush")
+	notifier.SetCodeRemap(nil)
+	fail(3, "restored")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 log lines, got %d", len(lines))
+	}
+
+	for i, expected := range [][2]int{{10, 3}, {4, 0}, {0, 0}, {3, 0}} {
+		entry := LogEntry{}
+		if errJson := json.Unmarshal([]byte(lines[i]), &entry); errJson != nil {
+			t.Fatal("Failed unmarshaling log entry")
+		}
+		if entry.Code != expected[0] || entry.OrigCode != expected[1] {
+			t.Errorf("Expected code %d (originally %d), got %d (originally %d)", expected[0], expected[1], entry.Code, entry.OrigCode)
+		}
+	}
+}
+
 func TestExitWithoutRunning(t *testing.T) {
 	old := ignoreStdOut(t)
 	defer func() { os.Stdout = old }()
@@ -213,9 +482,7 @@ func TestExitBacklog2(t *testing.T) {
 	}
 
 	go notifier.Run()
-	for !notifier.isReady() {
-		// wait for logging to start
-	}
+	notifier.WarmUp()
 
 	notifier.Exit() // wait for backlog to clear, then exit
 
@@ -225,6 +492,211 @@ func TestExitBacklog2(t *testing.T) {
 
 }
 
+func TestExitAsync(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestExitAsync.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	send := notifier.Sender("TestExitAsync")
+	for i := 1; i <= 50; i++ {
+		send("Creating backlog")
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	// Only one of concurrent exits stops the notifier
+	failed := 0
+	for _, done := range []<-chan error{notifier.ExitAsync(), notifier.ExitAsync()} {
+		select {
+		case err := <-done:
+			if err != nil {
+				failed++
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("ExitAsync did not finish")
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected one clean exit and one failed exit, got %d failed exits", failed)
+	}
+	if lines := readLogLines(t, logfile); len(lines) != 51 {
+		t.Errorf("Expected the backlog to be logged before exiting, got %d entries", len(lines))
+	}
+}
+
+func TestConcurrentExit(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestConcurrentExit.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Sender("TestConcurrentExit")("Hello, World!")
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- notifier.Exit()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed != 9 {
+		t.Errorf("Expected one clean exit and 9 failed exits, got %d failed exits", failed)
+	}
+	if err := notifier.Exit(); err == nil || !strings.Contains(err.Error(), "already exited") {
+		t.Errorf("Exiting an exited notifier should fail, got %v", err)
+	}
+	if lines := readLogLines(t, logfile); len(lines) != 2 {
+		t.Errorf("Expected the message and the exit entry, got %d entries", len(lines))
+	}
+}
+
+func TestSendWhileExiting(t *testing.T) {
+
+	for round := 0; round < 20; round++ {
+		notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 5, ioutil.Discard)
+		go notifier.Run()
+		notifier.WarmUp()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				send := notifier.Sender("TestSendWhileExiting")
+				for j := 0; j < 50; j++ {
+					send("Hello, World!") // must not panic once the notifier exits
+				}
+			}()
+		}
+
+		if err := notifier.Exit(); err != nil {
+			t.Fatal("Failed exiting the notifier: " + err.Error())
+		}
+		wg.Wait()
+	}
+}
+
+func TestAsyncWorkers(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestAsyncWorkers.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 10, logfile)
+	if err := notifier.SetAsyncWorkers(0); err == nil {
+		t.Error("A pool without workers should be rejected")
+	}
+	if err := notifier.SetAsyncWorkers(2); err != nil {
+		t.Fatal("Failed setting the async workers: " + err.Error())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Pause()
+
+	// The queued notes must not start a goroutine each
+	goroutines := runtime.NumGoroutine()
+	send := notifier.Sender("TestAsyncWorkers")
+	for i := 0; i < 15; i++ {
+		send("Hello, World!")
+	}
+	if started := runtime.NumGoroutine() - goroutines; started > 2 {
+		t.Errorf("Expected at most 2 additional goroutines, got %d", started)
+	}
+	if err := notifier.SetAsyncWorkers(1); err == nil {
+		t.Error("The number of workers should not change after the first asynchronous send")
+	}
+
+	notifier.Resume()
+	notifier.Exit()
+
+	if lines := readLogLines(t, logfile); len(lines) != 16 {
+		t.Errorf("Expected 15 entries and the exit entry, got %d entries", len(lines))
+	}
+}
+
+func TestOrderedAsync(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestOrderedAsync.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 10, logfile)
+	if err := notifier.SetOrderedAsync(true); err != nil {
+		t.Fatal("Failed enabling ordered asynchronous sends: " + err.Error())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	send := notifier.Sender("TestOrderedAsync")
+	for i := 0; i < 200; i++ {
+		send(strconv.Itoa(i))
+	}
+	if err := notifier.SetOrderedAsync(false); err == nil {
+		t.Error("The ordering should not change after the first asynchronous send")
+	}
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 201 {
+		t.Fatalf("Expected 200 entries and the exit entry, got %d entries", len(lines))
+	}
+	for i, line := range lines[:200] {
+		if !strings.HasSuffix(line, "\t"+strconv.Itoa(i)) {
+			t.Fatalf("Expected entry %d in line %d, got '%s'", i, i+1, line)
+		}
+	}
+}
+
+func TestSlowConfirm(t *testing.T) {
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	// A waiter that reads its confirm channel (like the one of SendSync) late
+	slow := make(chan bool, 1)
+	notifier.send(&note{Sender: "TestSlowConfirm", Value: "slow", Confirm: slow}, false)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			notifier.SendSync("TestSlowConfirm", "Hello, World!")
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("A slow waiter stalled the confirmations of other senders")
+	}
+
+	<-slow
+	notifier.Exit()
+}
+
 func TestUnsuportedEndpoint(t *testing.T) {
 	old := ignoreStdOut(t)
 	defer func() { os.Stdout = old }()
@@ -273,10 +745,11 @@ func TestUnsupportedValue(t *testing.T) {
 	}
 
 	send(badValue)
-	go notifier.Run()
-	for !notifier.isReady() {
-		// Wait for notifier to start
+	for notifier.Backlog() == 0 {
+		time.Sleep(time.Millisecond) // the note is sent asynchronously
 	}
+	go notifier.Run()
+	notifier.WarmUp()
 
 	outC := make(chan string)
 	go func() {
@@ -293,11 +766,12 @@ func TestUnsupportedValue(t *testing.T) {
 	os.Stdout = old
 	out := <-outC
 
+	// Internal warnings are written to os.Stderr
 	splits := strings.Split(out, "\n")
-	if len(splits) != 4 {
-		t.Error("Response from io.Pipe does not contain exactly four lines: " + strconv.Itoa(len(splits)))
+	if len(splits) != 3 {
+		t.Error("Response from io.Pipe does not contain exactly three lines: " + strconv.Itoa(len(splits)))
 	}
-	response := strings.Split(splits[1], "\t")
+	response := strings.Split(splits[0], "\t")
 
 	if len(response) != 8 {
 		t.Error("log: response does not contain 8 fields: " + strconv.Itoa(len(response)))
@@ -309,6 +783,25 @@ func TestUnsupportedValue(t *testing.T) {
 
 }
 
+func TestInternalWarnWriter(t *testing.T) {
+
+	var buf bytes.Buffer
+	SetInternalWarnWriter(&buf)
+	defer SetInternalWarnWriter(os.Stderr)
+
+	syswarn("Hello, World!")
+	if buf.String() != "notify: Hello, World!\n" {
+		t.Errorf("Unexpected internal warning: '%s'", buf.String())
+	}
+
+	buf.Reset()
+	SetInternalWarnWriter(nil)
+	syswarn("Hello, World!")
+	if buf.Len() > 0 {
+		t.Error("Internal warnings should be disabled")
+	}
+}
+
 func TestJSON(t *testing.T) {
 
 	logfile := os.Getenv("HOME") + "/mytestlog.log"
@@ -319,9 +812,7 @@ func TestJSON(t *testing.T) {
 	fail(0, "Hello, World")
 
 	go notifier.Run()
-	for !notifier.isReady() {
-		// Wait for notifier to start
-	}
+	notifier.WarmUp()
 	notifier.Exit()
 
 	contents, err := ioutil.ReadFile(logfile)
@@ -330,7 +821,7 @@ func TestJSON(t *testing.T) {
 	}
 
 	splits := strings.Split(string(contents), "\n")
-	log := logEntry{}
+	log := LogEntry{}
 	if errJson := json.Unmarshal([]byte(splits[0]), &log); errJson != nil {
 		t.Error("Failed unmarshaling log entry")
 	} else {
@@ -341,228 +832,2816 @@ func TestJSON(t *testing.T) {
 
 }
 
-func TestCodes(t *testing.T) {
+func TestCaller(t *testing.T) {
 
-	old := ignoreStdOut(t)
-	defer func() { os.Stdout = old }()
+	logfile := os.Getenv("HOME") + "/TestCaller.log"
+	defer os.Remove(logfile)
 
-	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100)
-	fail := notifier.Failure("TestCodes")
-	err1 := fail(0, "Hello, World")
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
 
-	if err1.Error()[0:12] != "Hello, World" {
-		t.Error("Wrong message returned by fail: " + err1.Error()[0:12])
-	}
+	err := notifier.Failure("TestCaller")(3, "boom")
+	_, _, line, _ := runtime.Caller(0)
+	notifier.Exit()
 
-	if IsCode(1, err1) {
-		t.Error("err1 has code 0, not 1")
+	if err.Error() != "boom" {
+		t.Errorf("The error should not contain the caller: '%s'", err.Error())
 	}
 
-	if !IsCode(1, errors.New("Oops")) {
-		t.Error("The standard error should be treated as if having code = 1")
+	entry := LogEntry{}
+	if errJson := json.Unmarshal([]byte(readLogLines(t, logfile)[0]), &entry); errJson != nil {
+		t.Fatal("Failed unmarshaling log entry")
+	}
+	if caller := "notify_test.go:" + strconv.Itoa(line-1); entry.Message != "boom" || entry.Caller != caller {
+		t.Errorf("Expected message 'boom' and caller '%s', got '%s' and '%s'", caller, entry.Message, entry.Caller)
 	}
 
+	entry.Fields = nil
+	if str := entry.toStr(); !strings.HasSuffix(str, "\tboom caller="+entry.Caller) {
+		t.Errorf("Caller is not appended to text entries: '%s'", str)
+	}
 }
 
-func TestBadLogRef(t *testing.T) {
-	old := ignoreStdOut(t)
-	defer func() { os.Stdout = old }()
+func TestSenderWithID(t *testing.T) {
 
-	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100, "/var/log/syslog")
-	notifier2 := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100, os.Getenv("HOME")+"/mytestdir/loggy.log")
-	defer os.Remove(os.Getenv("HOME") + "/mytestdir/loggy.log")
-	notifier3 := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100, os.Getenv("HOME"))
+	logfile := os.Getenv("HOME") + "/TestSenderWithID.log"
+	defer os.Remove(logfile)
 
-	if notifier.endpoints.endpointsPtr[0] != os.Stdout {
-		t.Error("Bad log reference should be replaced by os.Stdout")
-	}
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
 
-	if notifier2.endpoints.endpointsPtr[0] == nil {
-		t.Error("Failed attaching any endpoint")
-	}
+	notifier.SenderWithID("TestSenderWithID", "req-42")("Hello, World!")
+	notifier.SenderWithID("TestSenderWithID", "")("Goodbye, World!")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	entry := LogEntry{}
+	if errJson := json.Unmarshal([]byte(lines[0]), &entry); errJson != nil {
+		t.Fatal("Failed unmarshaling log entry")
+	}
+	if entry.TraceID != "req-42" {
+		t.Errorf("Expected trace ID 'req-42', got '%s'", entry.TraceID)
+	}
+	if str := entry.toStr(); !strings.HasSuffix(str, "\tHello, World! trace_id=req-42") {
+		t.Errorf("Trace ID is not appended to text entries: '%s'", str)
+	}
+	if strings.Contains(lines[1], "TraceID") {
+		t.Errorf("Empty trace IDs should be omitted: %s", lines[1])
+	}
+}
+
+// ctxKey is the type of the context keys of the tests
+type ctxKey string
+
+func TestSenderCtx(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestSenderCtx.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	send := notifier.SenderCtx("TestSenderCtx", ctxKey("trace_id"), ctxKey("user"))
+	ctx := context.WithValue(context.Background(), ctxKey("trace_id"), "abc123")
+	send(ctx, "Hello, World!")
+	send(context.Background(), "No request")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	entries := make([]LogEntry, 2)
+	for i := range entries {
+		if errJson := json.Unmarshal([]byte(lines[i]), &entries[i]); errJson != nil {
+			t.Fatal("Failed unmarshaling log entry")
+		}
+	}
+	if fields := entries[0].Fields; len(fields) != 1 || fields["trace_id"] != "abc123" {
+		t.Errorf("Expected the trace ID as the only field, got %v", fields)
+	}
+	if fields := entries[1].Fields; len(fields) != 0 {
+		t.Errorf("Missing keys should be omitted, got %v", fields)
+	}
+}
+
+func TestSend(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestSend.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	if err := Send(notifier, "TestSend", "Hello, World!"); err != nil {
+		t.Error("Sending a message should not return an error: " + err.Error())
+	}
+	if err := Send(notifier, "TestSend", errors.New("Oops")); err == nil || err.Error() != "Oops" {
+		t.Error("Sending an error should return it")
+	}
+	Send(notifier, "TestSend", notifier.Failure("TestSend")(3, "Sent once"))
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 4 || !strings.HasSuffix(lines[0], "\tTestSend\tMSG\t0\tGeneralMessage\tHello, World!") || !strings.Contains(lines[1], "\tOops") {
+		t.Errorf("Unexpected entries: %v", lines)
+	}
+}
+
+func TestCoded(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestCoded.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	coded := notifier.Coded("TestCoded")
+	if err := coded(404, "Page not found"); !IsCode(404, err) || err.Error() != "Page not found" {
+		t.Errorf("Expected an error with code 404, got %v", err)
+	}
+	coded(3, errors.New("Oops"))
+	coded(0, struct{ ID int }{42})
+	if err := coded(3, notifier.Sender("TestCoded")(errors.New("sent once"))); err != nil {
+		t.Errorf("Sent values should not be sent again, got %v", err)
+	}
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	expected := []string{"\tERR\t404\tHTTP-StatusNotFound\tPage not found", "\tERR\t3\tFailedAction\tOops", "\tMSG\t0\tGeneralMessage\t{42}", "sent once"}
+	if len(lines) != len(expected)+1 {
+		t.Fatalf("Expected %d entries, got %v", len(expected)+1, lines)
+	}
+	for i, entry := range expected {
+		if !strings.Contains(lines[i], entry) {
+			t.Errorf("Expected '%s' in line %d, got '%s'", entry, i+1, lines[i])
+		}
+	}
+}
+
+func TestFailureErr(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestFailureErr.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	_, cause := os.Open(os.Getenv("HOME") + "/TestFailureErr/missing.cfg")
+	fail := notifier.FailureErr("TestFailureErr")
+
+	err := fail(3, cause, "Could not open %s", "missing.cfg")
+	if !IsCode(3, err) || !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected code 3 and the cause to be kept, got %v", err)
+	}
+	var pathErr *os.PathError
+	if !errors.As(err, &pathErr) {
+		t.Error("The cause should be accessible with errors.As")
+	}
+	if err := fail(3, nil, "Without a cause"); errors.Unwrap(err) != nil || err.Error() != "Without a cause" {
+		t.Errorf("Unexpected error without a cause: %v", err)
+	}
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 3 || !strings.Contains(lines[0], "\tCould not open missing.cfg: "+cause.Error()) {
+		t.Errorf("Expected the message to end with the cause, got %v", lines)
+	}
+}
+
+func TestNewf(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestNewf.log"
+	defer os.Remove(logfile)
+
+	err := Newf(404, "Page %s not found", "/index.html")
+	if !IsCode(404, err) || err.Error() != "Page /index.html not found" {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	if err2 := New(3, "100% failed"); !IsCode(3, err2) || err2.Error() != "100% failed" {
+		t.Errorf("Unexpected error: %v", err2)
+	}
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	send := notifier.Sender("TestNewf")
+	sent := send(err)
+	if !IsCode(404, sent) {
+		t.Error("Send functions should return the sent notification")
+	}
+	send(sent) // already sent
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 2 || !strings.Contains(lines[0], "\tERR\t404\tHTTP-StatusNotFound\tPage /index.html not found") {
+		t.Errorf("Expected the notification to be logged once, got %v", lines)
+	}
+}
+
+// statusError is an error type of another package carrying a code
+type statusError struct {
+	status int
+}
+
+func (e statusError) Error() string {
+	return "status " + strconv.Itoa(e.status)
+}
+
+func (e statusError) Code() int {
+	return e.status
+}
+
+func TestCoder(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestCoder.log"
+	defer os.Remove(logfile)
+
+	if !IsCode(404, statusError{404}) {
+		t.Error("IsCode should recognize the code of a Coder")
+	}
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	send := notifier.Sender("TestCoder")
+	if sent := send(statusError{404}); !IsCode(404, sent) || !notifier.IsLevel("ERR", sent) {
+		t.Errorf("Expected the sent error to keep code 404, got %v", sent)
+	}
+	send(statusError{12345}) // unknown code
+	send(statusError{0})
+	if sent := notifier.SendBatch("TestCoder", []interface{}{statusError{404}}); !IsCode(404, sent) {
+		t.Errorf("Expected the batched error to keep code 404, got %v", sent)
+	}
+	notifier.Exit()
+
+	// The note about the unknown code is logged unless the notifier exits first
+	lines := []string{}
+	for _, line := range readLogLines(t, logfile) {
+		if !strings.Contains(line, "\tnotifier\t") {
+			lines = append(lines, line)
+		}
+	}
+	expected := []string{"\tERR\t404\tHTTP-StatusNotFound\tstatus 404", "\tERR\t1\tGeneralError\tstatus 12345", "\tERR\t1\tGeneralError\tstatus 0", "\tERR\t404\tHTTP-StatusNotFound\tstatus 404"}
+	if len(lines) != len(expected) {
+		t.Fatalf("Expected %d entries, got %v", len(expected), lines)
+	}
+	for i, entry := range expected {
+		if !strings.Contains(lines[i], entry) {
+			t.Errorf("Expected '%s' in line %d, got '%s'", entry, i+1, lines[i])
+		}
+	}
+}
+
+func TestParseLevelPrefix(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestParseLevelPrefix.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	notifier.SetParseLevelPrefix(true)
+	if err := notifier.SetLevelPrefixes(map[string]int{"crit": 4242}); err == nil {
+		t.Error("Level prefixes of unknown codes should be rejected")
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetParseLevelPrefix(false); err == nil {
+		t.Error("Parsing level tags should not change on a running notifier")
+	}
+
+	send := notifier.Sender("TestParseLevelPrefix")
+	send("[ERROR] disk full")
+	send("[warn]  disk almost full")
+	send("[INFO] disk checked")
+	send("[NOTICE] unknown tags are kept")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	expected := []string{
+		"\tERR\t1\tGeneralError\tdisk full",
+		"\tWRN\t5\tGeneralWarning\tdisk almost full",
+		"\tMSG\t0\tGeneralMessage\tdisk checked",
+		"\tMSG\t0\tGeneralMessage\t[NOTICE] unknown tags are kept",
+	}
+	for i, suffix := range expected {
+		if !strings.HasSuffix(lines[i], suffix) {
+			t.Errorf("Expected an entry ending in '%s', got '%s'", suffix, lines[i])
+		}
+	}
+}
+
+func TestCodes(t *testing.T) {
+
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100)
+	fail := notifier.Failure("TestCodes")
+	err1 := fail(0, "Hello, World")
+
+	if err1.Error()[0:12] != "Hello, World" {
+		t.Error("Wrong message returned by fail: " + err1.Error()[0:12])
+	}
+
+	if IsCode(1, err1) {
+		t.Error("err1 has code 0, not 1")
+	}
+
+	if !IsCode(1, errors.New("Oops")) {
+		t.Error("The standard error should be treated as if having code = 1")
+	}
+
+}
+
+func TestIsLevelAndStatus(t *testing.T) {
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+	fail := notifier.Failure("TestIsLevelAndStatus")
+
+	notFound := fail(404, "Page not found")
+	if !notifier.IsLevel("ERR", notFound) || !notifier.IsStatus("HTTP-StatusNotFound", notFound) {
+		t.Error("Code 404 should resolve to ERR and HTTP-StatusNotFound")
+	}
+
+	if message := fail(0, "Hello, World"); notifier.IsLevel("ERR", message) || !notifier.IsStatus("GeneralMessage", message) {
+		t.Error("Code 0 should resolve to MSG and GeneralMessage")
+	}
+
+	for _, err := range []error{errors.New("Oops"), fail(4242, "Unknown code")} {
+		if !notifier.IsLevel("ERR", err) || !notifier.IsStatus("GeneralError", err) {
+			t.Errorf("'%s' should be treated as if having code = 1", err.Error())
+		}
+	}
+
+	if notifier.IsLevel("ERR", nil) {
+		t.Error("No error has no level")
+	}
+	notifier.Exit()
+}
+
+func TestErrorCount(t *testing.T) {
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	notifier.SendSync("TestErrorCount", "Hello, World!")
+	if level := notifier.HighestLevelSeen(); level != "MSG" {
+		t.Errorf("Expected MSG to be the highest level, got '%s'", level)
+	}
+
+	notifier.Warn("TestErrorCount")("Disk almost full")
+	notifier.Failure("TestErrorCount")(3, "Failed opening a file")
+	notifier.Sender("TestErrorCount")(errors.New("Oops"))
+	notifier.SendSync("TestErrorCount", "Hello again")
+	notifier.Exit()
+
+	if count := notifier.ErrorCount(); count != 2 {
+		t.Errorf("Expected 2 logged errors, got %d", count)
+	}
+	if level := notifier.HighestLevelSeen(); level != "ERR" {
+		t.Errorf("Expected ERR to be the highest level, got '%s'", level)
+	}
+	if stats := notifier.Stats(); stats.Errors != 2 {
+		t.Errorf("Expected the stats to count 2 errors, got %d", stats.Errors)
+	}
+}
+
+func TestExitSummary(t *testing.T) {
+
+	for _, summary := range []bool{false, true} {
+		var buf bytes.Buffer
+		notifier := NewNotifier("MyService", "MyServiceInstance", false, false, true, 100, &buf)
+		if err := notifier.SetExitSummary(summary); err != nil {
+			t.Fatal("Failed setting the exit summary: " + err.Error())
+		}
+
+		go notifier.Run()
+		notifier.WarmUp()
+		if err := notifier.SetExitSummary(!summary); err == nil {
+			t.Error("The exit summary should not change on a running notifier")
+		}
+		notifier.SendSync("TestExitSummary", "not logged")
+		notifier.SendSync("TestExitSummary", errors.New("disk full"))
+		notifier.SendSync("TestExitSummary", errors.New("disk still full"))
+		notifier.Exit()
+
+		// The summary itself is logged after it was taken
+		expected := 2
+		if summary {
+			expected = 3
+		}
+		if stats := notifier.Stats(); stats.Entries != expected || stats.Levels["ERR"] != 2 {
+			t.Errorf("Expected %d entries, 2 of level ERR, got %d (%v)", expected, stats.Entries, stats.Levels)
+		}
+
+		// Messages are not logged (logAll=false), except for the summary
+		entries := []LogEntry{}
+		reader := NewLogReader(&buf)
+		for {
+			entry, err := reader.Next()
+			if err != nil {
+				break
+			}
+			entries = append(entries, entry)
+		}
+		if !summary {
+			if len(entries) != 2 {
+				t.Errorf("Expected 2 entries without summary, got %d", len(entries))
+			}
+			continue
+		}
+
+		if len(entries) != 3 {
+			t.Fatalf("Expected 3 entries with summary, got %d", len(entries))
+		}
+		fields := entries[2].Fields
+		if fields["entries"] != float64(2) || fields["err"] != float64(2) || fields["dropped"] != float64(0) || fields["write_failures"] != float64(0) {
+			t.Errorf("Unexpected summary: %v", fields)
+		}
+		if _, err := time.ParseDuration(fmt.Sprint(fields["duration"])); err != nil {
+			t.Errorf("Expected the duration of the run, got %v", fields["duration"])
+		}
+	}
+}
+
+func TestQuietExit(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestQuietExit.log"
+	defer os.Remove(logfile)
+
+	w := &countingWriter{}
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile, w)
+	if err := notifier.SetQuietExit(true); err != nil {
+		t.Fatal("Failed setting the quiet exit: " + err.Error())
+	}
+	notifier.SetWriteBatching(10, time.Hour)
+	notifier.SetFileBuffering(1<<16, time.Hour)
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetQuietExit(false); err == nil {
+		t.Error("The quiet exit should not change on a running notifier")
+	}
+	for i := 0; i < 5; i++ {
+		notifier.Sender("TestQuietExit")("Hello, World!")
+	}
+	if err := notifier.Exit(); err != nil {
+		t.Fatal("Failed exiting: " + err.Error())
+	}
+
+	// The batched and buffered backlog is written without the exit entry
+	if _, lines := w.counts(); lines != 5 {
+		t.Errorf("Expected 5 lines, got %d", lines)
+	}
+	lines := readLogLines(t, logfile)
+	if len(lines) != 5 || !strings.HasSuffix(lines[4], "Hello, World!") {
+		t.Errorf("Expected 5 entries without the exit entry, got %v", lines)
+	}
+}
+
+func TestBadLogRef(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100, "/var/log/syslog")
+	notifier2 := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100, os.Getenv("HOME")+"/mytestdir/loggy.log")
+	defer os.Remove(os.Getenv("HOME") + "/mytestdir/loggy.log")
+	notifier3 := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100, os.Getenv("HOME"))
+
+	if notifier.endpoints.endpointsPtr[0] != os.Stdout {
+		t.Error("Bad log reference should be replaced by os.Stdout")
+	}
+
+	if notifier2.endpoints.endpointsPtr[0] == nil {
+		t.Error("Failed attaching any endpoint")
+	}
+
+	if _, err := os.Stat(os.Getenv("HOME") + "/mytestdir/loggy.log"); os.IsNotExist(err) {
+		t.Error("Failed creating missing logfile")
+	}
+
+	if notifier3.endpoints.endpointsPtr[0] != os.Stdout {
+		t.Error("Used an existing directory as logfile. Should use os.Stdout instead")
+	}
+
+}
+
+func TestRepeatedEndpoints(t *testing.T) {
+
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100, os.Stdout, "mylog", os.Stdout)
+	defer os.Remove("mylog")
+
+	if len(notifier.endpoints.endpointsPtr) == 3 {
+		os.Stdout = old
+		fmt.Println(notifier.endpoints.endpointsPtr)
+		t.Error("Failed ignoring duplicate endpoints")
+	}
+
+}
+
+func TestStandardStreamEndpoints(t *testing.T) {
+
+	old := os.Stdout
+	stdout, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal("Cannot open " + os.DevNull)
+	}
+	os.Stdout = stdout
+	defer func() { os.Stdout = old; stdout.Close() }()
+
+	// A second handle of the same file as os.Stdout
+	other, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal("Cannot open " + os.DevNull)
+	}
+	defer other.Close()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, os.Stdout, other, os.Stdout)
+	if len(notifier.endpoints.endpointsPtr) != 1 || notifier.endpoints.endpointsPtr[0] != os.Stdout {
+		t.Errorf("Expected os.Stdout as the only endpoint, got %d endpoints", len(notifier.endpoints.endpointsPtr))
+	}
+	notifier.Exit()
+
+	if _, err := other.Write([]byte("")); err != nil {
+		t.Error("A canonicalized endpoint should not be closed by the notifier")
+	}
+
+	notifier2 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, os.Stderr, os.Stderr)
+	if len(notifier2.endpoints.endpointsPtr) != 1 || notifier2.endpoints.endpointsPtr[0] != os.Stderr {
+		t.Errorf("Expected os.Stderr as the only endpoint, got %d endpoints", len(notifier2.endpoints.endpointsPtr))
+	}
+	notifier2.Exit()
+}
+
+// valueWriter is a writer value that is not comparable (it contains a slice)
+type valueWriter struct {
+	lines *[]string
+	tags  []string
+}
+
+func (w valueWriter) Write(p []byte) (int, error) {
+	*w.lines = append(*w.lines, string(p))
+	return len(p), nil
+}
+
+func TestUncomparableEndpoints(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestUncomparableEndpoints.log"
+	defer os.Remove(logfile)
+
+	lines := []string{}
+	w := valueWriter{lines: &lines, tags: []string{"a"}}
+
+	// Writer values are neither hashed nor compared
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, w, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.SendSync("TestUncomparableEndpoints", "Hello, World!")
+
+	if err := notifier.RemoveEndpoint(w); err == nil {
+		t.Error("Writer values cannot be identified for removal")
+	}
+	if err := notifier.RemoveEndpoint(logfile); err != nil {
+		t.Error("Failed removing the log file: " + err.Error())
+	}
+	if err := notifier.FlushEndpoint("stdout"); err == nil {
+		t.Error("Expected no endpoint with the id stdout")
+	}
+	notifier.Exit()
+
+	if len(lines) != 2 || !strings.HasSuffix(strings.TrimSpace(lines[0]), "Hello, World!") {
+		t.Errorf("Expected 2 entries in the writer, got %v", lines)
+	}
+	if entries := readLogLines(t, logfile); len(entries) != 1 {
+		t.Errorf("Expected 1 entry in the removed log file, got %d", len(entries))
+	}
+}
+
+func TestStdSplit(t *testing.T) {
+
+	stdoutfile := os.Getenv("HOME") + "/TestStdSplit.stdout"
+	stderrfile := os.Getenv("HOME") + "/TestStdSplit.stderr"
+	defer os.Remove(stdoutfile)
+	defer os.Remove(stderrfile)
+
+	for _, mode := range []StdSplitMode{StdSplitAlso, StdSplitInstead} {
+		stdout, err := os.Create(stdoutfile)
+		if err != nil {
+			t.Fatal("Failed creating the stdout file: " + err.Error())
+		}
+		stderr, err := os.Create(stderrfile)
+		if err != nil {
+			t.Fatal("Failed creating the stderr file: " + err.Error())
+		}
+		oldOut, oldErr := os.Stdout, os.Stderr
+		os.Stdout, os.Stderr = stdout, stderr
+
+		var buf bytes.Buffer
+		notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, &buf, os.Stdout)
+		if err := notifier.SetStdSplit(StdSplitMode(3)); err == nil {
+			t.Error("An unknown mode should be rejected")
+		}
+		if err := notifier.SetStdSplit(mode); err != nil {
+			t.Fatal("Failed setting the standard stream split: " + err.Error())
+		}
+		go notifier.Run()
+		notifier.WarmUp()
+		if err := notifier.SetStdSplit(StdSplitOff); err == nil {
+			t.Error("The split should not change on a running notifier")
+		}
+		notifier.SendSync("TestStdSplit", "Hello, World!")
+		notifier.SendSync("TestStdSplit", errors.New("disk full"))
+		notifier.Exit()
+
+		os.Stdout, os.Stderr = oldOut, oldErr
+		stdout.Close()
+		stderr.Close()
+
+		// The endpoint os.Stdout receives all entries too, unless it is skipped
+		out := readLogLines(t, stdoutfile)
+		expected := 2
+		if mode == StdSplitAlso {
+			expected = 5
+		}
+		if len(out) != expected || !strings.HasSuffix(out[0], "Hello, World!") {
+			t.Errorf("Expected %d lines on stdout (mode %d), got %v", expected, mode, out)
+		}
+		if lines := readLogLines(t, stderrfile); len(lines) != 1 || !strings.Contains(lines[0], "disk full") {
+			t.Errorf("Expected the error on stderr (mode %d), got %v", mode, lines)
+		}
+		if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 3 {
+			t.Errorf("Expected all 3 entries in the other endpoint (mode %d), got %d", mode, len(lines))
+		}
+	}
+}
+
+func TestNoteToSelf(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100)
+
+	err1 := notifier.noteToSelf("simple message")
+	err2 := notifier.noteToSelf(errors.New("error message"))
+	err3 := notifier.noteToSelf(newf(999, 1, "error message"))
+
+	if err1 != nil {
+		t.Error("noteToSelf should return a string if string given")
+	}
+
+	if _, ok := err2.(error); !ok {
+		t.Error("noteToSelf should return an error if error given")
+	}
+
+	if _, ok := err3.(notification); !ok || err3.(notification).code != 999 {
+		t.Error("noteToSelf should return a notification with level 999 if error given")
+	}
+
+}
+
+func TestMissingCodes(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100)
+	notifier.notificationCodes = map[int][2]string{
+		0: [2]string{"MSG", "GeneralMessage"},
+		1: [2]string{"ERR", "GeneralError"},
+		3: [2]string{"ERR", "FailedAction"},
+	}
+
+	defer func() {
+		if r := recover(); r == nil {
+			t.Error("Should panic if sysCodes are missing!")
+		}
+	}()
+	notifier.isOK()
+
+}
+
+func TestEmptyNotifier(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/mytestlog2.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("", "", true, true, true, 100, logfile)
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	confirm := make(chan bool)
+	go notifier.lockedLog(&note{Sender: "", Value: "", Confirm: confirm})
+	<-confirm
+
+	go notifier.lockedLog(&note{Sender: "", Value: newf(1000, 2, "no such code"), Confirm: confirm})
+	<-confirm
+
+	notifier.Exit()
+
+	contents, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Error("Failed reading mytestlog.log: " + err.Error())
+	}
+
+	splits := strings.Split(string(contents), "\n")
+	log := LogEntry{}
+	if errJson := json.Unmarshal([]byte(splits[0]), &log); errJson != nil {
+		t.Error("Failed unmarshaling log entry")
+	}
+
+	if log.Service != "N/A" {
+		t.Errorf("Failed correcting missing service")
+	}
+	if log.Instance != "N/A" {
+		t.Errorf("Failed correcting missing instance")
+	}
+	if log.Sender != "N/A" {
+		t.Errorf("Failed correcting missing sender")
+	}
+	if log.Level != "MSG" {
+		t.Errorf("Failed correcting missing level")
+	}
+	if log.Code != 0 {
+		t.Errorf("Failed correcting missing code")
+	}
+	if log.Status != "GeneralMessage" {
+		t.Errorf("Failed correcting missing status")
+	}
+	if log.Message != "N/A" {
+		t.Errorf("Failed correcting missing message")
+	}
+
+	if errJson := json.Unmarshal([]byte(splits[1]), &log); errJson != nil {
+		t.Error("Failed unmarshaling log entry")
+	}
+
+	if log.Code != 1 {
+		t.Error("Failed correcting non-existing code")
+	}
+
+}
+
+func TestWarmUp(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("", "", true, true, true, 100)
+
+	select {
+	case <-notifier.Ready():
+		t.Error("The ready channel should not be closed before the notifier runs")
+	default:
+	}
+
+	if notifier.IsRunning() {
+		t.Error("The notifier should not be running before notifier.Run()")
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	if !notifier.IsRunning() {
+		t.Error("Warmup failed waiting for the notifier to start")
+	}
+
+	select {
+	case <-notifier.Ready():
+	default:
+		t.Error("The ready channel should be closed once the notifier runs")
+	}
+
+	notifier.Exit()
+	if notifier.IsRunning() {
+		t.Error("The notifier should not be running after notifier.Exit()")
+	}
+}
+
+func TestWarmUpTimeout(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("", "", true, true, true, 100)
+	if err := notifier.WarmUpTimeout(10 * time.Millisecond); err == nil {
+		t.Error("Warming up a notifier that is not running should time out")
+	}
+
+	go notifier.Run()
+	if err := notifier.WarmUpTimeout(time.Second); err != nil {
+		t.Error("Failed warming up a running notifier: " + err.Error())
+	}
+
+	notifier.Exit()
+}
+
+func TestTwoNotifiers(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	logfile := os.Getenv("HOME") + "/TestTwoNotifiers.log"
+	defer os.Remove(logfile)
+
+	notifier1 := NewNotifier("", "", true, true, true, 100, logfile, os.Stdout)
+	notifier2 := NewNotifier("", "", true, true, true, 100, logfile, os.Stdout) // logfile will not be used
+
+	n1Endpoints := len(notifier1.endpoints.endpointsPtr)
+	n2Endpoints := len(notifier2.endpoints.endpointsPtr)
+
+	if n1Endpoints != 2 || n2Endpoints == 2 {
+		t.Error("Failed to assign logfile for only one notifier " + strconv.Itoa(n1Endpoints) + " " + strconv.Itoa(n2Endpoints))
+	}
+
+}
+
+func expectNotifier(no *Notifier) error {
+	fail := no.Failure("test")
+	return fail(3, "Hello, World!")
+}
+
+func TestNotifierStruct(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, os.Stdout)
+
+	if expectNotifier(notifier).Error()[0:13] != "Hello, World!" {
+		t.Error("Failed passing notifier as function argument")
+	}
+
+}
+
+func TestFatal(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestFatal.log"
+	defer os.Remove(logfile)
+
+	exitCode := 0
+	osExit = func(code int) { exitCode = code }
+	defer func() { osExit = os.Exit }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", false, false, false, 100, logfile)
+	notifier.SetFatalExitCode(3)
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	notifier.Fatal("TestFatal", 10, "Cannot continue: %s", "out of memory")
+
+	if exitCode != 3 {
+		t.Errorf("Fatal: expected exit code 3, got %d", exitCode)
+	}
+
+	if notifier.isReady() {
+		t.Error("Fatal: notifier should not be running after Fatal")
+	}
+
+	contents, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Error("Failed reading TestFatal.log: " + err.Error())
+	}
+
+	if !strings.Contains(string(contents), "Cannot continue: out of memory") {
+		t.Error("Fatal: notification was not written before exiting")
+	}
+}
+
+func TestResetFileEndpointRegistry(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	logfile := os.Getenv("HOME") + "/TestResetFileEndpointRegistry.log"
+	defer os.Remove(logfile)
+
+	notifier1 := NewNotifier("", "", true, true, true, 100, logfile)
+	defer notifier1.Exit()
+
+	ResetFileEndpointRegistry()
+
+	notifier2 := NewNotifier("", "", true, true, true, 100, logfile)
+	defer notifier2.Exit()
+
+	if len(notifier2.endpoints.endpointsPtr) != 1 || notifier2.endpoints.endpointsPtr[0] == os.Stdout {
+		t.Error("Failed attaching a previously used logfile after resetting the registry")
+	}
+}
+
+func includeFuncSender(no *Notifier) {
+	fail := no.Failure("TestIncludeFunc")
+	fail(3, "Hello, World!")
+}
+
+func TestIncludeFunc(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestIncludeFunc.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	notifier.SetIncludeFunc(true)
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetIncludeFunc(false); err == nil {
+		t.Error("Including function names should not change on a running notifier")
+	}
+
+	includeFuncSender(notifier)
+	notifier.Exit()
+
+	contents, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Error("Failed reading TestIncludeFunc.log: " + err.Error())
+	}
+
+	log := LogEntry{}
+	if errJson := json.Unmarshal([]byte(strings.Split(string(contents), "\n")[0]), &log); errJson != nil {
+		t.Error("Failed unmarshaling log entry")
+	}
+
+	if !strings.HasSuffix(log.Func, ".includeFuncSender") {
+		t.Errorf("Expected the calling function to be includeFuncSender, got '%s'", log.Func)
+	}
+}
+
+func TestIncludeGoroutine(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestIncludeGoroutine.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	notifier.SetIncludeGoroutine(true)
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetIncludeGoroutine(false); err == nil {
+		t.Error("Including goroutine ids should not change on a running notifier")
+	}
+
+	send := notifier.Sender("TestIncludeGoroutine")
+	send("first")
+	send("second")
+	done := make(chan bool)
+	go func() {
+		send("other goroutine")
+		done <- true
+	}()
+	<-done
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	ids := make([]int64, 3)
+	for i := range ids {
+		entry := LogEntry{}
+		if errJson := json.Unmarshal([]byte(lines[i]), &entry); errJson != nil {
+			t.Fatal("Failed unmarshaling log entry")
+		}
+		ids[i] = entry.Goroutine
+	}
+
+	if ids[0] == 0 || ids[0] != ids[1] || ids[0] == ids[2] {
+		t.Errorf("Expected the same id for entries of one goroutine only, got %v", ids)
+	}
+}
+
+func TestIncludeSeq(t *testing.T) {
+
+	for _, json := range []bool{false, true} {
+
+		logfile := os.Getenv("HOME") + "/TestIncludeSeq.log"
+
+		notifier := NewNotifier("MyService", "MyServiceInstance", false, false, json, 100, logfile)
+		notifier.SetIncludeSeq(true)
+		go notifier.Run()
+		notifier.WarmUp()
+		if err := notifier.SetIncludeSeq(false); err == nil {
+			t.Error("Numbering entries should not change on a running notifier")
+		}
+
+		send := notifier.Sender("TestIncludeSeq")
+		send(errors.New("first"))
+		send("skipped") // messages are not logged
+		send(errors.New("second"))
+		notifier.Exit()
+
+		f, err := os.Open(logfile)
+		if err != nil {
+			t.Fatal("Failed opening the log file: " + err.Error())
+		}
+		reader := NewLogReader(f)
+		first, _ := reader.Next()
+		second, _ := reader.Next()
+		f.Close()
+		os.Remove(logfile)
+
+		if json && (first.Seq != 1 || second.Seq != 2) {
+			t.Errorf("Expected sequence numbers 1 and 2, got %d and %d", first.Seq, second.Seq)
+		}
+		if !json && (!strings.HasSuffix(first.Message, " seq=1") || !strings.HasSuffix(second.Message, " seq=2")) {
+			t.Errorf("Expected sequence numbers 1 and 2, got '%s' and '%s'", first.Message, second.Message)
+		}
+	}
+}
+
+func TestFieldProvider(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestFieldProvider.log"
+	defer os.Remove(logfile)
+
+	// A goroutine-local store of request IDs
+	var lock sync.Mutex
+	requests := map[int64]string{}
+	provider := func() map[string]interface{} {
+		lock.Lock()
+		defer lock.Unlock()
+		if id, ok := requests[goroutineID()]; ok {
+			return map[string]interface{}{"request": id}
+		}
+		return nil
+	}
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	if err := notifier.SetFieldProvider(provider); err != nil {
+		t.Fatal("Failed setting the field provider: " + err.Error())
+	}
+	go notifier.Run()
+	notifier.WarmUp()
+
+	done := make(chan bool)
+	go func() {
+		lock.Lock()
+		requests[goroutineID()] = "req-42"
+		lock.Unlock()
+
+		notifier.SendSync("TestFieldProvider", "Handling request")
+		notifier.SendChange("TestFieldProvider", "request", "old", "new")
+		done <- true
+	}()
+	<-done
+	notifier.SendSync("TestFieldProvider", "No request")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	entries := make([]LogEntry, 3)
+	for i := range entries {
+		if errJson := json.Unmarshal([]byte(lines[i]), &entries[i]); errJson != nil {
+			t.Fatal("Failed unmarshaling log entry")
+		}
+	}
+
+	if entries[0].Fields["request"] != "req-42" {
+		t.Errorf("Expected the provided request ID, got %v", entries[0].Fields)
+	}
+	if entries[1].Fields["field"] != "request" || entries[1].Fields["request"] != "req-42" {
+		t.Errorf("Provided fields should be added to the fields of the sender, got %v", entries[1].Fields)
+	}
+	if len(entries[2].Fields) != 0 {
+		t.Errorf("Entries of other goroutines should not carry the request ID, got %v", entries[2].Fields)
+	}
+}
+
+func TestOnLog(t *testing.T) {
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", false, false, false, 100, ioutil.Discard)
+
+	calls := []string{}
+	counts := map[string]int{}
+	notifier.OnLog(func(entry LogEntry) {
+		calls = append(calls, "first")
+		counts[entry.Level]++
+	})
+	notifier.OnLog(func(entry LogEntry) {
+		calls = append(calls, "second")
+	})
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	fail := notifier.Failure("TestOnLog")
+	fail(3, "Failed")
+	fail(404, "Not found")
+	notifier.SendSync("TestOnLog", "Suppressed message")
+	notifier.Exit()
+
+	if counts["ERR"] != 2 || counts["MSG"] != 0 {
+		t.Errorf("Expected callbacks for 2 errors only, got %v", counts)
+	}
+	if strings.Join(calls, ",") != "first,second,first,second" {
+		t.Errorf("Callbacks were not called in registration order: %v", calls)
+	}
+}
+
+func TestErrNotifierClosed(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	for _, async := range []bool{false, true} {
+		notifier := NewNotifier("MyService", "MyServiceInstance", true, async, false, 100)
+		send := notifier.Sender("TestErrNotifierClosed")
+		fail := notifier.Failure("TestErrNotifierClosed")
+
+		go notifier.Run()
+		notifier.WarmUp()
+
+		if err := send("Hello, World!"); err != nil {
+			t.Error("Sending to a running notifier should not fail: " + err.Error())
+		}
+
+		notifier.Exit()
+
+		if err := send("Are you still there?"); !errors.Is(err, ErrNotifierClosed) {
+			t.Errorf("Expected ErrNotifierClosed for a string sent to a closed notifier (async=%t)", async)
+		}
+
+		if err := fail(3, "Are you still there?"); !errors.Is(err, ErrNotifierClosed) {
+			t.Errorf("Expected ErrNotifierClosed for a failure sent to a closed notifier (async=%t)", async)
+		}
+	}
+}
+
+// readLogLines returns the non-empty lines of a log file
+func readLogLines(t *testing.T, logfile string) []string {
+	contents, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Error("Failed reading " + logfile + ": " + err.Error())
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(string(contents), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestStructuredStack(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestStructuredStack.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	notifier.SetStructuredStack(10, 5)
+	fail := notifier.Failure("TestStructuredStack")
+	fail(10, "Catastrophic failure")
+	fail(3, "Minor failure")
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetStructuredStack(1, 5); err == nil {
+		t.Error("Stack frames should not change on a running notifier")
+	}
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	catastrophic, minor := LogEntry{}, LogEntry{}
+	json.Unmarshal([]byte(lines[0]), &catastrophic)
+	json.Unmarshal([]byte(lines[1]), &minor)
+
+	if len(catastrophic.Frames) == 0 || len(catastrophic.Frames) > 5 {
+		t.Fatalf("Expected 1-5 stack frames, got %d", len(catastrophic.Frames))
+	}
+	frame := catastrophic.Frames[0]
+	if !strings.HasSuffix(frame.Function, ".TestStructuredStack") || !strings.HasSuffix(frame.File, "notify_test.go") || frame.Line <= 0 {
+		t.Errorf("Unexpected stack frame: %+v", frame)
+	}
+	if len(minor.Frames) > 0 {
+		t.Error("Entries below the minimum code should not carry stack frames")
+	}
+}
+
+func TestSeparatorsInJSON(t *testing.T) {
+
+	for _, jsoned := range []bool{true, false} {
+		logfile := os.Getenv("HOME") + "/TestSeparatorsInJSON.log"
+
+		notifier := NewNotifier("MyService", "MyServiceInstance", true, false, jsoned, 100, logfile)
+		send := notifier.Sender("TestSeparatorsInJSON")
+		send("Hello,\tWorld!")
+
+		go notifier.Run()
+		notifier.WarmUp()
+		notifier.Exit()
+
+		lines := readLogLines(t, logfile)
+		os.Remove(logfile)
+		ResetFileEndpointRegistry()
+
+		if jsoned {
+			log := LogEntry{}
+			if errJson := json.Unmarshal([]byte(lines[0]), &log); errJson != nil {
+				t.Error("Failed unmarshaling log entry")
+			}
+			if log.Message != "Hello,\tWorld!" {
+				t.Errorf("JSON message should keep the tab, got '%s'", log.Message)
+			}
+		} else {
+			if fields := strings.Split(lines[0], "\t"); len(fields) != 8 || fields[7] != "Hello, World!" {
+				t.Errorf("Text message should have the tab replaced, got '%s'", lines[0])
+			}
+		}
+	}
+}
+
+func TestFallback(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	fallbackfile := os.Getenv("HOME") + "/TestFallback.log"
+	defer os.Remove(fallbackfile)
+
+	fallback, err := os.Create(fallbackfile)
+	if err != nil {
+		t.Fatal("Failed creating the fallback file: " + err.Error())
+	}
+	defer fallback.Close()
+
+	// A closed file cannot be written to
+	broken, _ := os.Open(os.DevNull)
+	broken.Close()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, broken)
+	notifier.SetFallback(fallback)
+	send := notifier.Sender("TestFallback")
+	send("Hello, World!")
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Exit()
+
+	lines := readLogLines(t, fallbackfile)
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "Hello, World!") {
+		t.Errorf("Expected two entries in the fallback file, got %d", len(lines))
+	}
+
+	if failures := notifier.Stats().WriteFailures; failures != 2 {
+		t.Errorf("Expected 2 write failures, got %d", failures)
+	}
+
+	// The fallback can be set on a running notifier
+	fallback.Truncate(0)
+	fallback.Seek(0, 0)
+	notifier = NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, broken)
+	notifier.SetFallback(nil)
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.SetFallback(fallback)
+	notifier.SendSync("TestFallback", "Hello again!")
+	notifier.Exit()
+
+	lines = readLogLines(t, fallbackfile)
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "Hello again!") {
+		t.Errorf("Expected two entries in the fallback file of a running notifier, got %v", lines)
+	}
+}
+
+func TestLastWrite(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	var buf bytes.Buffer
+	broken, _ := os.Open(os.DevNull)
+	broken.Close()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, broken)
+	notifier.SetFallback(nil)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	notifier.SendSync("TestLastWrite", "Hello, World!")
+	if !notifier.LastWrite().IsZero() {
+		t.Error("LastWrite should not advance if all endpoints fail")
+	}
+
+	before := time.Now()
+	notifier.AddEndpoint(&buf)
+	notifier.SendSync("TestLastWrite", "Hello, World!")
+	if last := notifier.LastWrite(); last.Before(before) || time.Since(last) > time.Second {
+		t.Errorf("LastWrite is not recent: %v", last)
+	}
+	notifier.Exit()
+}
+
+func TestHealth(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	var buf bytes.Buffer
+	broken, _ := os.Open(os.DevNull)
+	broken.Close()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, &buf)
+	notifier.SetFallback(nil)
+	if err := notifier.Health(); err == nil {
+		t.Error("A notifier that is not running should not be healthy")
+	}
+	if err := notifier.SetHealthBacklog(2); err != nil {
+		t.Fatal("Failed setting the health backlog: " + err.Error())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetHealthBacklog(5); err == nil {
+		t.Error("The health backlog should not change on a running notifier")
+	}
+
+	notifier.SendSync("TestHealth", "Hello, World!")
+	if err := notifier.Health(); err != nil {
+		t.Error("Expected a healthy notifier, got " + err.Error())
+	}
+
+	notifier.Pause()
+	send := notifier.Sender("TestHealth")
+	for i := 0; i < 3; i++ {
+		send(errors.New("waiting"))
+	}
+	if err := notifier.Health(); err == nil || !strings.Contains(err.Error(), "saturated") {
+		t.Errorf("Expected a saturated notifier, got %v", err)
+	}
+	notifier.Resume()
+
+	notifier.AddEndpoint(broken)
+	notifier.SendSync("TestHealth", "Hello, World!")
+	if err := notifier.Health(); err == nil || !strings.Contains(err.Error(), "failed writing") {
+		t.Errorf("Expected a failed write, got %v", err)
+	}
+
+	notifier.RemoveEndpoint(broken)
+	notifier.SendSync("TestHealth", "Hello, World!")
+	if err := notifier.Health(); err != nil {
+		t.Error("The notifier should recover once all endpoints are writable, got " + err.Error())
+	}
+
+	notifier.Exit()
+	if err := notifier.Health(); err == nil {
+		t.Error("An exited notifier should not be healthy")
+	}
+
+	if err := NoopNotifier().Health(); err != nil {
+		t.Error("A noop notifier should always be healthy, got " + err.Error())
+	}
+}
+
+func TestHealthStdAndFlush(t *testing.T) {
+	old := os.Stdout
+	defer func() { os.Stdout = old }()
+
+	// A closed file cannot be written to
+	broken, _ := os.Open(os.DevNull)
+	broken.Close()
+
+	// Failed writes to the standard streams
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+	notifier.SetStdSplit(StdSplitAlso)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	os.Stdout = broken
+	notifier.SendSync("TestHealthStdAndFlush", "Hello, World!")
+	os.Stdout = old
+	if err := notifier.Health(); err == nil || !strings.Contains(err.Error(), "failed writing") {
+		t.Errorf("Expected a failed write to os.Stdout, got %v", err)
+	}
+	notifier.Exit()
+
+	// Failed flushes of buffered log files
+	logfile := os.Getenv("HOME") + "/TestHealthStdAndFlush.log"
+	defer os.Remove(logfile)
+
+	notifier = NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	notifier.SetFallback(nil)
+	notifier.SetFileBuffering(4096, time.Hour)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	notifier.endpoints.Lock()
+	notifier.endpoints.endpointsPtr[0].(*bufferedFile).file.Close()
+	notifier.endpoints.Unlock()
+
+	notifier.SendSync("TestHealthStdAndFlush", "Hello, World!") // buffered, then flushed
+	if err := notifier.Health(); err == nil || !strings.Contains(err.Error(), "failed writing") {
+		t.Errorf("Expected a failed flush, got %v", err)
+	}
+	notifier.Exit()
+}
+
+func TestExitGrace(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	SetExitGrace(20 * time.Millisecond)
+	defer SetExitGrace(0)
+
+	dumpfile := os.Getenv("HOME") + "/TestExitGrace.log"
+	defer os.Remove(dumpfile)
+	dump, err := os.Create(dumpfile)
+	if err != nil {
+		t.Fatal("Failed creating the dump file: " + err.Error())
+	}
+	defer dump.Close()
+
+	// A slowly read pipe keeps the notifier busy
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("Failed creating a pipe: " + err.Error())
+	}
+	defer r.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			if _, err := r.Read(buf); err != nil {
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 5000, w)
+	notifier.SetFallback(dump)
+	send := notifier.Sender("TestExitGrace")
+	for i := 0; i < 5000; i++ {
+		send("Creating backlog")
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	start := time.Now()
+	notifier.Exit()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Exit should return shortly after the grace period, took %s", elapsed)
+	}
+
+	if lines := readLogLines(t, dumpfile); len(lines) == 0 {
+		t.Error("The remaining backlog was not dumped after the grace period")
+	}
+}
+
+// slowWriter takes 100ms per write
+type slowWriter struct{}
+
+func (slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(100 * time.Millisecond)
+	return len(p), nil
+}
+
+func TestExitGraceAsync(t *testing.T) {
+
+	SetExitGrace(20 * time.Millisecond)
+	defer SetExitGrace(0)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 10, slowWriter{})
+	notifier.SetFallback(nil)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	// The async workers wait for the busy notifier
+	send := notifier.Sender("TestExitGraceAsync")
+	for i := 0; i < 20; i++ {
+		send("Creating backlog")
+	}
+
+	start := time.Now()
+	notifier.Exit()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Exit should not wait for the async workers beyond the grace period, took %s", elapsed)
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestPauseResume.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	send := notifier.Sender("TestPauseResume")
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	notifier.Pause()
+
+	for i := 1; i <= 3; i++ {
+		send(strconv.Itoa(i))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if lines := readLogLines(t, logfile); len(lines) != 0 {
+		t.Errorf("A paused notifier should not write to endpoints, found %d entries", len(lines))
+	}
+
+	notifier.Resume()
+	notifier.SendSync("TestPauseResume", "4")
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 entries after resuming, got %d", len(lines))
+	}
+	for i, line := range lines {
+		if !strings.HasSuffix(line, "\t"+strconv.Itoa(i+1)) {
+			t.Errorf("Entries logged out of order after resuming: %s", line)
+		}
+	}
+
+	notifier.Pause()
+	notifier.Exit() // must not block on a paused notifier
+}
+
+func TestSendChange(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestSendChange.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	notifier.SendChange("TestSendChange", "retries", 3, 5)
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Exit()
+
+	log := LogEntry{}
+	if errJson := json.Unmarshal([]byte(readLogLines(t, logfile)[0]), &log); errJson != nil {
+		t.Fatal("Failed unmarshaling log entry")
+	}
+
+	if log.Message != "retries changed from 3 to 5" {
+		t.Errorf("Unexpected message: '%s'", log.Message)
+	}
+
+	if log.Fields["field"] != "retries" || log.Fields["old"] != float64(3) || log.Fields["new"] != float64(5) {
+		t.Errorf("Unexpected fields: %v", log.Fields)
+	}
+}
+
+func TestSendWithTimeout(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestSendWithTimeout.log"
+	defer os.Remove(logfile)
+
+	// The note channel of a notifier that is not running fills up
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 1, logfile)
+	if err := notifier.SendWithTimeout("TestSendWithTimeout", "queued", 10*time.Millisecond); err != nil {
+		t.Error("Failed sending to a channel with free capacity: " + err.Error())
+	}
+	start := time.Now()
+	if err := notifier.SendWithTimeout("TestSendWithTimeout", "dropped", 10*time.Millisecond); err != ErrSendTimeout {
+		t.Errorf("Expected ErrSendTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("The send should have given up after the timeout, took %s", elapsed)
+	}
+	if err := notifier.SendWithTimeout("TestSendWithTimeout", "invalid", 0); !IsCode(4, err) {
+		t.Errorf("A non-positive timeout should be rejected, got %v", err)
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "queued") {
+		t.Errorf("Expected only the queued note to be logged, got %v", lines)
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestSendBatch.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	// Interleaving sender
+	done := make(chan struct{})
+	go func() {
+		send := notifier.Sender("other")
+		for i := 0; i < 50; i++ {
+			send("other")
+		}
+		close(done)
+	}()
+
+	values := []interface{}{}
+	for i := 0; i < 50; i++ {
+		values = append(values, "batch "+strconv.Itoa(i))
+	}
+	first := errors.New("first error")
+	values = append(values, first, errors.New("second error"))
+
+	if err := notifier.SendBatch("TestSendBatch", values); err == nil || !strings.HasPrefix(err.Error(), "first error") {
+		t.Errorf("Expected the first error to be returned, got %v", err)
+	}
+	<-done
+	notifier.Exit()
+
+	batch := []string{}
+	lastIndex := -1
+	for i, line := range readLogLines(t, logfile) {
+		if fields := strings.Split(line, "\t"); fields[3] == "TestSendBatch" {
+			if lastIndex >= 0 && i != lastIndex+1 {
+				t.Fatal("Batch entries were interleaved with other entries")
+			}
+			lastIndex = i
+			batch = append(batch, fields[7])
+		}
+	}
+
+	if len(batch) != 52 || batch[0] != "batch 0" || batch[49] != "batch 49" || !strings.HasPrefix(batch[50], "first error") {
+		t.Errorf("Batch entries are missing or out of order: %v", batch)
+	}
+}
+
+func TestAddRemoveEndpoint(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	logfile := os.Getenv("HOME") + "/TestAddRemoveEndpoint.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, os.Stdout)
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	if err := notifier.AddEndpoint(logfile); err != nil {
+		t.Fatal("Failed adding an endpoint: " + err.Error())
+	}
+	if err := notifier.AddEndpoint(struct{}{}); err == nil {
+		t.Error("Adding an unsupported endpoint should fail")
+	}
+
+	notifier.SendSync("TestAddRemoveEndpoint", "Hello, World!")
+
+	if err := notifier.RemoveEndpoint(logfile); err != nil {
+		t.Fatal("Failed removing an endpoint: " + err.Error())
+	}
+	if err := notifier.RemoveEndpoint(logfile); err == nil {
+		t.Error("Removing an endpoint twice should fail")
+	}
+
+	notifier.SendSync("TestAddRemoveEndpoint", "Goodbye, World!")
+	notifier.Exit()
+
+	if lines := readLogLines(t, logfile); len(lines) != 1 || !strings.HasSuffix(lines[0], "Hello, World!") {
+		t.Errorf("Expected only the entry sent before removing the endpoint, got %d entries", len(lines))
+	}
+
+	// The removed file can be used by another notifier
+	notifier2 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if len(notifier2.endpoints.endpointsPtr) != 1 || notifier2.endpoints.endpointsPtr[0] == os.Stdout {
+		t.Error("A removed file endpoint should be released")
+	}
+	notifier2.RemoveEndpoint(logfile)
+}
+
+func TestEnvGatedEndpoint(t *testing.T) {
+
+	os.Setenv("NOTIFY_TEST_ENV", "dev")
+	defer os.Unsetenv("NOTIFY_TEST_ENV")
+
+	var buf bytes.Buffer
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100,
+		EnvGatedEndpoint(&buf, "NOTIFY_TEST_ENV", "dev"),
+		EnvGatedEndpoint(os.Stderr, "NOTIFY_TEST_ENV", "prod"))
+
+	if len(notifier.endpoints.endpointsPtr) != 1 || notifier.endpoints.endpointsPtr[0] != &buf {
+		t.Errorf("Expected only the endpoint of the matching environment, got %d endpoints", len(notifier.endpoints.endpointsPtr))
+	}
+
+	if err := notifier.AddEndpoint(EnvGatedEndpoint(os.Stderr, "NOTIFY_TEST_ENV", "prod")); err != nil || len(notifier.endpoints.endpointsPtr) != 1 {
+		t.Error("A gated endpoint of another environment should be skipped")
+	}
+	notifier.Exit()
+}
+
+func TestReopen(t *testing.T) {
+
+	dir := os.Getenv("HOME") + "/TestReopen"
+	logfile := dir + "/TestReopen.log"
+	defer os.RemoveAll(dir)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	// Rotation
+	notifier.SendSync("TestReopen", "before rotation")
+	if err := os.Rename(logfile, logfile+".1"); err != nil {
+		t.Fatal("Failed rotating the log file: " + err.Error())
+	}
+	if err := notifier.Reopen(); err != nil {
+		t.Error("Failed reopening the log file: " + err.Error())
+	}
+	notifier.SendSync("TestReopen", "after rotation")
+	if lines := readLogLines(t, logfile); len(lines) != 1 || !strings.HasSuffix(lines[0], "after rotation") {
+		t.Errorf("Log file was not reopened: %v", lines)
+	}
+
+	// Failed rotation into a directory that cannot be created
+	previous, err := os.Open(logfile)
+	if err != nil {
+		t.Fatal("Failed opening the log file: " + err.Error())
+	}
+	defer previous.Close()
+	os.RemoveAll(dir)
+	ioutil.WriteFile(dir, []byte{}, 0600)
+
+	if err := notifier.Reopen(); !IsCode(3, err) {
+		t.Error("Reopening into an unwritable directory should fail")
+	}
+	notifier.SendSync("TestReopen", "kept")
+	notifier.Exit()
+
+	contents, _ := ioutil.ReadAll(previous)
+	if !strings.Contains(string(contents), "Failed reopening log files") || !strings.Contains(string(contents), "kept") {
+		t.Errorf("Previous log file was not kept: '%s'", contents)
+	}
+}
+
+func TestFileHeader(t *testing.T) {
+
+	dir := os.Getenv("HOME") + "/TestFileHeader"
+	logfile := dir + "/TestFileHeader.log"
+	defer os.RemoveAll(dir)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if err := notifier.SetFileHeader(true); err != nil {
+		t.Fatal("Failed enabling the file header: " + err.Error())
+	}
+	go notifier.Run()
+	notifier.WarmUp()
+
+	notifier.SendSync("TestFileHeader", "before rotation")
+	os.Rename(logfile, logfile+".1")
+	notifier.Reopen()
+	notifier.SendSync("TestFileHeader", "after rotation")
+	notifier.Exit()
+
+	for _, file := range []string{logfile + ".1", logfile} {
+		lines := readLogLines(t, file)
+		header := fileHeader{}
+		if len(lines) == 0 || json.Unmarshal([]byte(lines[0]), &header) != nil {
+			t.Fatalf("Expected %s to start with a header, got %v", file, lines)
+		}
+		if header.Header != "fractal-notify" || header.Format != "text" || header.Service != "MyService" || len(header.Fields) != 8 {
+			t.Errorf("Unexpected header of %s: %v", file, header)
+		}
+	}
+
+	// Files that already contain entries are appended to without a header
+	appending := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	appending.SetFileHeader(true)
+	go appending.Run()
+	appending.WarmUp()
+	appending.SendSync("TestFileHeader", "appended")
+	appending.Exit()
+
+	f, err := os.Open(logfile)
+	if err != nil {
+		t.Fatal("Failed opening the log file: " + err.Error())
+	}
+	defer f.Close()
+	reader := NewLogReader(f)
+	if entry, err := reader.Next(); err != nil || entry.Message != "after rotation" {
+		t.Errorf("The log reader should skip the header, got %v (%v)", entry, err)
+	}
+	if lines := readLogLines(t, logfile); len(lines) != 5 {
+		t.Errorf("Expected a single header in %s, got %v", logfile, lines)
+	}
+}
+
+func TestFlushEndpoint(t *testing.T) {
+
+	var bufA, bufB bytes.Buffer
+	a, b := bufio.NewWriter(&bufA), bufio.NewWriter(&bufB)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, NamedWriter("a", a), NamedWriter("b", b))
+	go notifier.Run()
+	notifier.WarmUp()
+
+	notifier.SendSync("TestFlushEndpoint", "Hello, World!")
+	if err := notifier.FlushEndpoint("a"); err != nil {
+		t.Error("Failed flushing endpoint a: " + err.Error())
+	}
+	if err := notifier.FlushEndpoint("c"); err == nil {
+		t.Error("Flushing an unknown endpoint should fail")
+	}
+
+	if !strings.HasSuffix(bufA.String(), "Hello, World!\n") {
+		t.Errorf("Flushed endpoint has unexpected contents: '%s'", bufA.String())
+	}
+	if bufB.Len() > 0 {
+		t.Error("Endpoint b should not be flushed")
+	}
+	notifier.Exit()
+}
+
+// countingWriter counts write calls
+type countingWriter struct {
+	sync.Mutex
+	buf    bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) counts() (int, int) {
+	w.Lock()
+	defer w.Unlock()
+	return w.writes, strings.Count(w.buf.String(), "\n")
+}
+
+func TestWriteBatching(t *testing.T) {
+
+	w := &countingWriter{}
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, w)
+	if err := notifier.SetWriteBatching(10, 0); err == nil {
+		t.Error("Batching without an interval should be rejected")
+	}
+	if err := notifier.SetWriteBatching(10, time.Hour); err != nil {
+		t.Fatal("Failed setting write batching: " + err.Error())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	for i := 0; i < 25; i++ {
+		notifier.SendSync("TestWriteBatching", "Hello, World!")
+	}
+	if writes, lines := w.counts(); writes != 2 || lines != 20 {
+		t.Errorf("Expected 20 lines in 2 writes, got %d lines in %d writes", lines, writes)
+	}
+
+	notifier.Exit()
+	if writes, lines := w.counts(); writes != 3 || lines != 26 {
+		t.Errorf("Expected 26 lines in 3 writes at exit, got %d lines in %d writes", lines, writes)
+	}
+
+	// Batched entries are written once the interval has passed
+	w2 := &countingWriter{}
+	notifier2 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, w2)
+	notifier2.SetWriteBatching(10, 20*time.Millisecond)
+	go notifier2.Run()
+	notifier2.WarmUp()
+
+	notifier2.SendSync("TestWriteBatching", "Hello, World!")
+	time.Sleep(100 * time.Millisecond)
+	if writes, lines := w2.counts(); writes != 1 || lines != 1 {
+		t.Errorf("Expected 1 line after the interval, got %d lines in %d writes", lines, writes)
+	}
+	notifier2.Exit()
+}
+
+func TestFileBuffering(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestFileBuffering.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if err := notifier.SetFileBuffering(1<<16, 0); err == nil {
+		t.Error("Buffering without a flush interval should be rejected")
+	}
+	if err := notifier.SetFileBuffering(1<<16, time.Hour); err != nil {
+		t.Fatal("Failed setting file buffering: " + err.Error())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	if err := notifier.SetFileBuffering(0, 0); err == nil {
+		t.Error("Buffering of a running notifier should not change")
+	}
+
+	send := notifier.Sender("TestFileBuffering")
+	send("buffered")
+	time.Sleep(10 * time.Millisecond)
+	if lines := readLogLines(t, logfile); len(lines) != 0 {
+		t.Errorf("Entries should be buffered, found %d entries", len(lines))
+	}
+
+	if err := notifier.Flush(); err != nil {
+		t.Error("Failed flushing: " + err.Error())
+	}
+	if lines := readLogLines(t, logfile); len(lines) != 1 {
+		t.Errorf("Expected 1 entry after flushing, got %d", len(lines))
+	}
+
+	notifier.SendSync("TestFileBuffering", "synchronous")
+	if lines := readLogLines(t, logfile); len(lines) != 2 {
+		t.Errorf("Synchronous sends should be written to the file, got %d entries", len(lines))
+	}
+
+	send("buffered at exit")
+	notifier.Exit()
+	if lines := readLogLines(t, logfile); len(lines) != 4 {
+		t.Errorf("Expected 4 entries after exit, got %d", len(lines))
+	}
+}
+
+func TestMaxLineLen(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestMaxLineLen.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	notifier.SetMaxLineLen(128)
+	send := notifier.Sender("TestMaxLineLen")
+	send(strings.Repeat("x", 1000))
+	send("short")
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetMaxLineLen(0); err == nil {
+		t.Error("The length limit of lines should not change on a running notifier")
+	}
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines[0]) != 128 || !strings.HasSuffix(lines[0], "...") {
+		t.Errorf("Expected a line of 128 bytes ending with an ellipsis, got %d bytes: %s", len(lines[0]), lines[0])
+	}
+	if !strings.HasSuffix(lines[1], "\tshort") {
+		t.Error("Short lines should not be truncated")
+	}
+}
+
+func TestMaxMessageLen(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestMaxMessageLen.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	notifier.SetMaxMessageLen(5)
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetMaxMessageLen(0); err == nil {
+		t.Error("The length limit of messages should not change on a running notifier")
+	}
+
+	notifier.SendSync("TestMaxMessageLen", "Grüße, World!") // ü is two bytes long
+	notifier.SendChange("TestMaxMessageLen", "greeting", "Hi", "Hello, World!")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	entries := make([]LogEntry, 2)
+	for i := range entries {
+		if errJson := json.Unmarshal([]byte(lines[i]), &entries[i]); errJson != nil {
+			t.Fatal("Failed unmarshaling log entry")
+		}
+	}
+
+	if entries[0].Message != "Grü... (11 bytes truncated)" {
+		t.Errorf("Unexpected truncated message: '%s'", entries[0].Message)
+	}
+	if entries[1].Fields["new"] != "Hello... (8 bytes truncated)" || entries[1].Fields["old"] != "Hi" || entries[1].Fields["field"] != "greet... (3 bytes truncated)" {
+		t.Errorf("Unexpected truncated fields: %v", entries[1].Fields)
+	}
+}
+
+func TestMultiline(t *testing.T) {
+
+	message := "panic: boom\n\tmain.go:42\r\nexit\\status"
+	for mode, expected := range map[MultilineMode][]string{
+		MultilineFlatten: {"panic: boom  main.go:42  exit\\status"},
+		MultilineEscape:  {"panic: boom\\n\\tmain.go:42\\r\\nexit\\\\status"},
+		MultilineIndent:  {"panic: boom", "\t main.go:42", "\texit\\status"},
+	} {
+		notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, ioutil.Discard)
+		notifier.SetMultiline(mode)
+
+		lg := notifier.entry(&note{Sender: "TestMultiline", Value: message})
+		lines := strings.Split(lg.toStr(), "\n")
+		if len(lines) != len(expected) || !strings.HasSuffix(lines[0], "\t"+expected[0]) || strings.Join(lines[1:], "\n") != strings.Join(expected[1:], "\n") {
+			t.Errorf("Unexpected text entry of mode %d: %q", mode, lines)
+		}
+		notifier.Exit()
+	}
+
+	// JSON entries keep line breaks
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, ioutil.Discard)
+	if lg := notifier.entry(&note{Sender: "TestMultiline", Value: message}); lg.Message != message {
+		t.Errorf("JSON entries should keep line breaks, got %q", lg.Message)
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetMultiline(MultilineIndent); err == nil {
+		t.Error("The line breaks of messages should not change on a running notifier")
+	}
+	notifier.Exit()
+}
+
+func TestReleaseFileEndpointsOnExit(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	logfile := os.Getenv("HOME") + "/TestReleaseFileEndpointsOnExit.log"
+	defer os.Remove(logfile)
+
+	notifier1 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	go notifier1.Run()
+	notifier1.WarmUp()
+	notifier1.Exit()
+
+	notifier2 := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	defer notifier2.Exit()
+
+	if len(notifier2.endpoints.endpointsPtr) != 1 || notifier2.endpoints.endpointsPtr[0] == os.Stdout {
+		t.Error("Exit should release the log files of a notifier")
+	}
+}
+
+func TestNoopNotifier(t *testing.T) {
+
+	old := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal("Failed to setup test: " + err.Error())
+	}
+	os.Stdout = w
+	defer func() { os.Stdout = old }()
+
+	notifier := NoopNotifier()
+	select {
+	case <-notifier.Ready():
+	default:
+		t.Error("The ready channel of a noop notifier should be closed")
+	}
+	go notifier.Run()
+	notifier.WarmUp()
+
+	send := notifier.Sender("TestNoopNotifier")
+	fail := notifier.Failure("TestNoopNotifier")
+	original := errors.New("Oops")
+
+	if err := send("Hello, World!"); err != nil {
+		t.Error("Sending a string should not return an error")
+	}
+	if err := send(original); err != original {
+		t.Error("Sending an error should return the same error")
+	}
+	if err := fail(3, "Failed %s", "again"); !IsCode(3, err) || !strings.HasPrefix(err.Error(), "Failed again") {
+		t.Error("Failure should return a notification with the given code")
+	}
+	if err := notifier.SendSync("TestNoopNotifier", "Hello, World!"); err != nil {
+		t.Error("SendSync should not block or fail")
+	}
+	if err := notifier.Exit(); err != nil {
+		t.Error("Exit should not fail: " + err.Error())
+	}
+
+	w.Close()
+	os.Stdout = old
+	if out, _ := ioutil.ReadAll(r); len(out) > 0 {
+		t.Errorf("A noop notifier should not write anything, got '%s'", out)
+	}
+
+	discard := NewDiscardNotifier()
+	if err := discard.Sender("TestNoopNotifier")(original); !discard.noop || err != original {
+		t.Error("A discard notifier should be a noop notifier returning errors")
+	}
+}
+
+func TestConcurrentNotifiers(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	logfile := os.Getenv("HOME") + "/TestConcurrentNotifiers.log"
+	defer os.Remove(logfile)
+
+	notifiers := make(chan *Notifier, 50)
+	for i := 0; i < 50; i++ {
+		go func() {
+			notifiers <- NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+		}()
+	}
+
+	attached := 0
+	for i := 0; i < 50; i++ {
+		notifier := <-notifiers
+		if len(notifier.endpoints.endpointsPtr) == 1 && notifier.endpoints.endpointsPtr[0] != os.Stdout {
+			attached++
+			defer notifier.RemoveEndpoint(logfile)
+		}
+	}
+
+	if attached != 1 {
+		t.Errorf("Exactly one notifier should use the log file, got %d", attached)
+	}
+}
+
+func TestTemplates(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100)
+	if err := notifier.SetTemplates(map[int]string{404: "resource %s not found"}); err != nil {
+		t.Fatal("Failed setting templates: " + err.Error())
+	}
+
+	fail := notifier.Failure("TestTemplates")
+
+	if err := fail(404, "users/42"); !strings.HasPrefix(err.Error(), "resource users/42 not found") {
+		t.Errorf("Template was not applied: '%s'", err.Error())
+	}
+	if err := fail(404, "users/%d", 43); !strings.HasPrefix(err.Error(), "resource users/43 not found") {
+		t.Errorf("Template was not applied to a formatted message: '%s'", err.Error())
+	}
+	if err := fail(3, "users/42"); !strings.HasPrefix(err.Error(), "users/42") {
+		t.Errorf("Codes without a template should use the raw message: '%s'", err.Error())
+	}
+}
+
+func TestDigest(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestDigest.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 1000, logfile)
+	if err := notifier.SetDigest(3, time.Hour); err != nil {
+		t.Fatal("Failed setting a digest: " + err.Error())
+	}
+
+	fail := notifier.Failure("TestDigest")
+	for i := 1; i <= 250; i++ {
+		fail(3, "Attempt %d failed", i)
+	}
+	fail(2, "Not digested")
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 entries (failure, digest, exit), got %d", len(lines))
+	}
+
+	fields := strings.Split(lines[1], "\t")
+	if fields[5] != "3" || !strings.HasPrefix(fields[7], "Code 3 occurred 250 times in the last 1h0m0s (latest: Attempt 250 failed") {
+		t.Errorf("Unexpected digest entry: %s", lines[1])
+	}
+}
+
+func TestFirstAlwaysSampling(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestFirstAlwaysSampling.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if err := notifier.SetFirstAlwaysSampling(3, 2, time.Hour); err == nil {
+		t.Error("A sampling rate above 1 should be rejected")
+	}
+	if err := notifier.SetFirstAlwaysSampling(3, 0.25, time.Hour); err != nil {
+		t.Fatal("Failed setting sampling: " + err.Error())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	fail := notifier.Failure("TestFirstAlwaysSampling")
+	for i := 1; i <= 9; i++ {
+		fail(3, "Attempt %d failed", i)
+	}
+	fail(4, "Not sampled")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 log lines, got %d", len(lines))
+	}
+	for i, attempt := range []string{"Attempt 1 ", "Attempt 5 ", "Attempt 9 "} {
+		if !strings.Contains(lines[i], attempt) {
+			t.Errorf("Expected '%s' to be logged, got '%s'", attempt, lines[i])
+		}
+	}
+	if dropped := notifier.Stats().Dropped; dropped != 6 {
+		t.Errorf("Expected 6 dropped entries, got %d", dropped)
+	}
+}
+
+func TestUniqueInstances(t *testing.T) {
+
+	var out bytes.Buffer
+	SetInternalWarnWriter(&out)
+	defer SetInternalWarnWriter(os.Stderr)
+
+	SetUniqueInstances(true)
+	defer SetUniqueInstances(false)
+
+	devNull, _ := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	defer devNull.Close()
+
+	notifier1 := NewNotifier("TestUniqueInstances", "instance_01", true, false, false, 100, devNull)
+	notifier2 := NewNotifier("TestUniqueInstances", "instance_01", true, false, false, 100, devNull)
+	notifier2.Exit()
+	notifier1.Exit()
+	notifier3 := NewNotifier("TestUniqueInstances", "instance_01", true, false, false, 100, devNull)
+	notifier3.Exit()
+
+	if warnings := strings.Count(out.String(), "instance_01 is already used"); warnings != 1 {
+		t.Errorf("Expected one warning about shared names, got %d", warnings)
+	}
+}
+
+func TestBacklogCapacity(t *testing.T) {
+	old := ignoreStdOut(t)
+	defer func() { os.Stdout = old }()
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100)
+	send := notifier.Sender("TestBacklogCapacity")
+	for i := 1; i <= 30; i++ {
+		send("Creating backlog")
+	}
+
+	if notifier.Backlog() != 30 {
+		t.Errorf("Expected a backlog of 30, got %d", notifier.Backlog())
+	}
+	if notifier.Capacity() != 100 {
+		t.Errorf("Expected a capacity of 100, got %d", notifier.Capacity())
+	}
+}
+
+// framedFormatter writes length-prefixed messages without line breaks
+type framedFormatter struct{}
+
+func (framedFormatter) Format(entry LogEntry) string {
+	return strconv.Itoa(len(entry.Message)) + ":" + entry.Message
+}
+
+func (framedFormatter) NeedsNewline() bool {
+	return false
+}
+
+func TestFormatterFraming(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestFormatterFraming.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if err := notifier.SetFormatter(framedFormatter{}); err != nil {
+		t.Fatal("Failed setting the formatter: " + err.Error())
+	}
+
+	send := notifier.Sender("TestFormatterFraming")
+	send("Hello")
+	send("World!")
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Exit()
 
-	if _, err := os.Stat(os.Getenv("HOME") + "/mytestdir/loggy.log"); os.IsNotExist(err) {
-		t.Error("Failed creating missing logfile")
+	contents, err := ioutil.ReadFile(logfile)
+	if err != nil {
+		t.Fatal("Failed reading TestFormatterFraming.log: " + err.Error())
 	}
 
-	if notifier3.endpoints.endpointsPtr[0] != os.Stdout {
-		t.Error("Used an existing directory as logfile. Should use os.Stdout instead")
+	if !strings.HasPrefix(string(contents), "5:Hello6:World!") || strings.Contains(string(contents), "\n") {
+		t.Errorf("A formatter handling its own framing should not get line breaks: '%s'", contents)
+	}
+}
+
+func TestResize(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestResize.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 10, logfile)
+	send := notifier.Sender("TestResize")
+	for i := 1; i <= 10; i++ {
+		send(strconv.Itoa(i))
+	}
+
+	if err := notifier.Resize(5); err == nil {
+		t.Error("Resizing below the backlog should fail")
 	}
+	if err := notifier.Resize(100); err != nil {
+		t.Fatal("Failed resizing: " + err.Error())
+	}
+	if notifier.Capacity() != 100 || notifier.Backlog() != 10 {
+		t.Errorf("Expected capacity 100 and backlog 10, got %d and %d", notifier.Capacity(), notifier.Backlog())
+	}
+
+	go notifier.Run()
+	notifier.WarmUp()
+
+	for i := 11; i <= 20; i++ {
+		send(strconv.Itoa(i))
+		if i == 15 {
+			if err := notifier.Resize(50); err != nil {
+				t.Error("Failed resizing a running notifier: " + err.Error())
+			}
+		}
+	}
+	notifier.Exit()
 
+	lines := readLogLines(t, logfile)
+	if len(lines) != 21 {
+		t.Fatalf("Expected 21 entries, got %d", len(lines))
+	}
+	for i, line := range lines[:20] {
+		if !strings.HasSuffix(line, "\t"+strconv.Itoa(i+1)) {
+			t.Errorf("Entries logged out of order after resizing: %s", line)
+		}
+	}
 }
 
-func TestRepeatedEndpoints(t *testing.T) {
+func TestResizeConcurrent(t *testing.T) {
 
-	old := ignoreStdOut(t)
-	defer func() { os.Stdout = old }()
+	logfile := os.Getenv("HOME") + "/TestResizeConcurrent.log"
+	defer os.Remove(logfile)
 
-	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100, os.Stdout, "mylog", os.Stdout)
-	defer os.Remove("mylog")
+	const count = 2000
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 10, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
 
-	if len(notifier.endpoints.endpointsPtr) == 3 {
-		os.Stdout = old
-		fmt.Println(notifier.endpoints.endpointsPtr)
-		t.Error("Failed ignoring duplicate endpoints")
+	// Resize while notes are received from the replaced channels
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		send := notifier.Sender("TestResizeConcurrent")
+		for i := 0; i < count; i++ {
+			send(strconv.Itoa(i))
+		}
+	}()
+	for i := 0; i < 50; i++ {
+		if err := notifier.Resize(count + i); err != nil {
+			t.Error("Failed resizing a running notifier: " + err.Error())
+		}
 	}
+	<-done
+	notifier.Exit()
 
+	lines := readLogLines(t, logfile)
+	if len(lines) != count+1 {
+		t.Fatalf("Expected %d entries, got %d", count+1, len(lines))
+	}
+	for i, line := range lines[:count] {
+		if !strings.HasSuffix(line, "\t"+strconv.Itoa(i)) {
+			t.Fatalf("Entries logged out of order while resizing: %s", line)
+		}
+	}
 }
 
-func TestNoteToSelf(t *testing.T) {
+func TestPanicHandler(t *testing.T) {
 	old := ignoreStdOut(t)
 	defer func() { os.Stdout = old }()
 
-	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100)
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100)
+	notifier.OnLog(func(entry LogEntry) {
+		if entry.Sender == "TestPanicHandler" {
+			panic("cannot handle " + entry.Sender)
+		}
+	})
 
-	err1 := notifier.noteToSelf("simple message")
-	err2 := notifier.noteToSelf(errors.New("error message"))
-	err3 := notifier.noteToSelf(newf(999, 1, "error message"))
+	recovered := make(chan string, 10)
+	notifier.SetPanicHandler(func(r interface{}, entry LogEntry) {
+		recovered <- fmt.Sprintf("%v|%s", r, entry.Message)
+	})
 
-	if err1 != nil {
-		t.Error("noteToSelf should return a string if string given")
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetPanicHandler(nil); err == nil {
+		t.Error("The panic handler should not change on a running notifier")
 	}
 
-	if _, ok := err2.(error); !ok {
-		t.Error("noteToSelf should return an error if error given")
+	notifier.SendSync("TestPanicHandler", "Hello, World!")
+	notifier.Exit()
+
+	if r := <-recovered; r != "cannot handle TestPanicHandler|Hello, World!" {
+		t.Errorf("Panic handler received unexpected values: %s", r)
 	}
+	if len(recovered) != 0 {
+		t.Errorf("Expected a single recovered panic, got %d more", len(recovered))
+	}
+}
 
-	if _, ok := err3.(notification); !ok || err3.(notification).code != 999 {
-		t.Error("noteToSelf should return a notification with level 999 if error given")
+// slowFormatter blocks while formatting entries of the sender "slow"
+type slowFormatter struct{}
+
+func (slowFormatter) Format(entry LogEntry) string {
+	if entry.Sender == "slow" {
+		time.Sleep(time.Second)
 	}
+	return entry.Message
+}
 
+func (slowFormatter) NeedsNewline() bool {
+	return true
 }
 
-func TestMissingCodes(t *testing.T) {
-	old := ignoreStdOut(t)
-	defer func() { os.Stdout = old }()
+func TestFormatTimeout(t *testing.T) {
 
-	notifier := NewNotifier("MyService", "MyServiceInstance", true, true, false, 100)
-	notifier.notificationCodes = map[int][2]string{
-		0: [2]string{"MSG", "GeneralMessage"},
-		1: [2]string{"ERR", "GeneralError"},
-		3: [2]string{"ERR", "FailedAction"},
+	logfile := os.Getenv("HOME") + "/TestFormatTimeout.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	notifier.SetFormatter(slowFormatter{})
+	if err := notifier.SetFormatTimeout(50 * time.Millisecond); err != nil {
+		t.Fatal("Failed setting the format timeout: " + err.Error())
 	}
 
-	defer func() {
-		if r := recover(); r == nil {
-			t.Error("Should panic if sysCodes are missing!")
-		}
-	}()
-	notifier.isOK()
+	go notifier.Run()
+	notifier.WarmUp()
 
+	if err := notifier.SetFormatTimeout(time.Second); err == nil {
+		t.Error("Changing the format timeout of a running notifier should fail")
+	}
+
+	start := time.Now()
+	notifier.SendSync("slow", strings.Repeat("x", 1000))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Slow formatting was not interrupted: %v", elapsed)
+	}
+	notifier.SendSync("fast", "Hello, World!")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 log lines, got %d", len(lines))
+	}
+	if !strings.HasSuffix(lines[0], "... (formatting timed out)") || len(lines[0]) > 512 {
+		t.Errorf("Unexpected fallback entry: '%s'", lines[0])
+	}
+	if lines[1] != "Hello, World!" {
+		t.Errorf("Logging did not continue after a timeout: '%s'", lines[1])
+	}
 }
 
-func TestEmptyNotifier(t *testing.T) {
+func TestRouteWarnings(t *testing.T) {
 
-	logfile := os.Getenv("HOME") + "/mytestlog2.log"
+	var warnings bytes.Buffer
+	SetInternalWarnWriter(&warnings)
+	defer SetInternalWarnWriter(os.Stderr)
+
+	logfile := os.Getenv("HOME") + "/TestRouteWarnings.log"
 	defer os.Remove(logfile)
 
-	notifier := NewNotifier("", "", true, true, true, 100, logfile)
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	notifier.SetFormatter(slowFormatter{})
+	notifier.SetFormatTimeout(50 * time.Millisecond)
+	notifier.SetRouteWarnings(true)
 
 	go notifier.Run()
-	for !notifier.isReady() {
-		// Wait for start
+	notifier.WarmUp()
+	if err := notifier.SetRouteWarnings(false); err == nil {
+		t.Error("Routing internal warnings should not change on a running notifier")
 	}
+	notifier.SendSync("slow", "Hello, World!")
+	notifier.Exit()
 
-	confirm := make(chan bool)
-	go notifier.log(&note{"", "", confirm})
-	<-confirm
+	lines := readLogLines(t, logfile)
+	if len(lines) != 3 || lines[1] != "formatting an entry of slow timed out after 50ms" {
+		t.Errorf("Internal warning was not logged: %v", lines)
+	}
+	if warnings.Len() > 0 {
+		t.Errorf("Routed warning was written to the internal warning sink: '%s'", warnings.String())
+	}
+}
 
-	go notifier.log(&note{"", newf(1000, 2, "no such code"), confirm})
-	<-confirm
+func TestRouteConversionWarnings(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestRouteConversionWarnings.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, logfile)
+	notifier.SetRouteWarnings(true)
+	go notifier.Run()
+	notifier.WarmUp()
 
+	notifier.SendChange("TestRouteConversionWarnings", "channel", make(chan int), nil) // channels cannot be converted to JSON
+	notifier.SendSync("TestRouteConversionWarnings", "Hello, World!")
 	notifier.Exit()
 
-	contents, err := ioutil.ReadFile(logfile)
-	if err != nil {
-		t.Error("Failed reading mytestlog.log: " + err.Error())
+	found := false
+	for _, line := range readLogLines(t, logfile) {
+		var entry LogEntry
+		if json.Unmarshal([]byte(line), &entry) == nil && entry.Code == 998 && strings.HasPrefix(entry.Message, "Could not convert LogEntry to JSON") {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("The failed conversion was not logged as an internal warning")
 	}
+}
 
-	splits := strings.Split(string(contents), "\n")
-	log := logEntry{}
-	if errJson := json.Unmarshal([]byte(splits[0]), &log); errJson != nil {
-		t.Error("Failed unmarshaling log entry")
+// locationFormatter writes the time zone of entries
+type locationFormatter struct{}
+
+func (locationFormatter) Format(entry LogEntry) string {
+	return entry.Time.Location().String()
+}
+
+func (locationFormatter) NeedsNewline() bool {
+	return true
+}
+
+func TestUTC(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestUTC.log"
+	defer os.Remove(logfile)
+
+	for _, jsoned := range []bool{true, false} {
+		for _, toggled := range []bool{false, true} {
+			notifier := NewNotifier("MyService", "MyServiceInstance", true, false, jsoned, 100, logfile)
+			notifier.SetFormatter(locationFormatter{})
+			if toggled {
+				notifier.SetUTC(!jsoned)
+			}
+			go notifier.Run()
+			notifier.WarmUp()
+			if err := notifier.SetUTC(jsoned); err == nil {
+				t.Error("The time zone should not change on a running notifier")
+			}
+			notifier.SendSync("TestUTC", "Hello, World!")
+			notifier.Exit()
+		}
 	}
 
-	if log.Service != "N/A" {
-		t.Errorf("Failed correcting missing service")
+	expected := []string{"UTC", "UTC", "Local", "Local", "Local", "Local", "UTC", "UTC"}
+	lines := readLogLines(t, logfile)
+	if strings.Join(lines, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected time zones %v, got %v", expected, lines)
 	}
-	if log.Instance != "N/A" {
-		t.Errorf("Failed correcting missing instance")
+}
+
+func TestClock(t *testing.T) {
+
+	var buf bytes.Buffer
+	var clockLock sync.Mutex
+	tick := time.Date(2017, 1, 1, 12, 0, 1, 0, time.UTC)
+	advance := func(d time.Duration) {
+		clockLock.Lock()
+		tick = tick.Add(d)
+		clockLock.Unlock()
 	}
-	if log.Sender != "N/A" {
-		t.Errorf("Failed correcting missing sender")
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, &buf)
+	if err := notifier.SetClock(func() time.Time {
+		clockLock.Lock()
+		defer clockLock.Unlock()
+		return tick
+	}); err != nil {
+		t.Fatal("Failed setting the clock: " + err.Error())
 	}
-	if log.Level != "MSG" {
-		t.Errorf("Failed correcting missing level")
+	notifier.SetFirstAlwaysSampling(3, 0.1, time.Minute)
+
+	go notifier.Run()
+	notifier.WarmUp()
+	if err := notifier.SetClock(nil); err == nil {
+		t.Error("The clock should not change on a running notifier")
 	}
-	if log.Code != 0 {
-		t.Errorf("Failed correcting missing code")
+	notifier.SendSync("TestClock", "first")
+	if expected := time.Date(2017, 1, 1, 12, 0, 1, 0, time.UTC); !notifier.LastWrite().Equal(expected) {
+		t.Errorf("Expected the last write at %v, got %v", expected, notifier.LastWrite())
 	}
-	if log.Status != "GeneralMessage" {
-		t.Errorf("Failed correcting missing status")
+	advance(time.Second)
+	notifier.SendSync("TestClock", "second")
+
+	// The sampling window follows the clock
+	notifier.SendSync("TestClock", New(3, "sampled"))
+	notifier.SendSync("TestClock", New(3, "dropped"))
+	advance(time.Minute)
+	notifier.SendSync("TestClock", New(3, "sampled again"))
+	notifier.Exit()
+
+	entries := []LogEntry{}
+	reader := NewLogReader(&buf)
+	for {
+		entry, err := reader.Next()
+		if err != nil {
+			break
+		}
+		entries = append(entries, entry)
 	}
-	if log.Message != "N/A" {
-		t.Errorf("Failed correcting missing message")
+	if len(entries) < 2 {
+		t.Fatalf("Expected at least 2 entries, got %d", len(entries))
+	}
+	for i, entry := range entries[:2] {
+		if expected := time.Date(2017, 1, 1, 12, 0, i+1, 0, time.UTC).Unix(); int64(entry.Timestamp) != expected {
+			t.Errorf("Expected timestamp %d of entry %d, got %d", expected, i, entry.Timestamp)
+		}
+	}
+	if stats := notifier.Stats(); stats.Dropped != 1 {
+		t.Errorf("Expected 1 entry dropped by sampling, got %d", stats.Dropped)
 	}
 
-	if errJson := json.Unmarshal([]byte(splits[1]), &log); errJson != nil {
-		t.Error("Failed unmarshaling log entry")
+	notifier = NewNotifier("MyService", "MyServiceInstance", true, false, true, 100, ioutil.Discard)
+	notifier.SetClock(nil)
+	if notifier.now == nil {
+		t.Error("A nil clock should restore time.Now")
 	}
+	notifier.Exit()
+}
 
-	if log.Code != 1 {
-		t.Error("Failed correcting non-existing code")
+func TestSenderNormalizer(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestSenderNormalizer.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if err := notifier.SetSenderNormalizer(strings.ToLower); err != nil {
+		t.Fatal("Failed setting the sender normalizer: " + err.Error())
 	}
 
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.SendSync("MyWorker", "Hello, World!")
+	notifier.Exit()
+
+	if fields := strings.Split(readLogLines(t, logfile)[0], "\t"); fields[3] != "myworker" {
+		t.Errorf("Sender was not normalized: '%s'", fields[3])
+	}
 }
 
-func TestWarmUp(t *testing.T) {
-	old := ignoreStdOut(t)
-	defer func() { os.Stdout = old }()
+func TestCallerInfo(t *testing.T) {
 
-	notifier := NewNotifier("", "", true, true, true, 100)
+	var buf bytes.Buffer
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, &buf)
+	if err := notifier.SetCallerInfo(func(location string) string {
+		if strings.HasPrefix(location, "notify_test.go:") {
+			return "golden.go:1"
+		}
+		return ""
+	}); err != nil {
+		t.Fatal("Failed setting the caller info: " + err.Error())
+	}
 
 	go notifier.Run()
 	notifier.WarmUp()
+	if err := notifier.SetCallerInfo(nil); err == nil {
+		t.Error("The caller info should not change on a running notifier")
+	}
+	fail := notifier.Failure("TestCallerInfo")
+	fail(1, "Fixed caller")
+	notifier.SendSync("TestCallerInfo", newf(1, 0, "Dropped caller")) // caller in notify_private.go
+	notifier.Exit()
 
-	if !notifier.isReady() {
-		t.Error("Warmup failed waiting for the notifier to start")
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) < 2 || !strings.HasSuffix(lines[0], "Fixed caller caller=golden.go:1") {
+		t.Errorf("Expected the overridden caller, got %v", lines)
 	}
+	if len(lines) < 2 || !strings.HasSuffix(lines[1], "Dropped caller") {
+		t.Errorf("Expected no caller, got %v", lines)
+	}
+}
+
+func TestWarn(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestWarn.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", false, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
 
+	notifier.Sender("TestWarn")("Suppressed message")
+	if err := notifier.Warn("TestWarn")("Disk %d%% full", 90); err != nil {
+		t.Error("Warn should not return an error: " + err.Error())
+	}
 	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 1 {
+		t.Fatalf("Expected only the warning to be logged, got %d lines", len(lines))
+	}
+	if fields := strings.Split(lines[0], "\t"); fields[4] != "WRN" || fields[5] != "5" || !strings.HasPrefix(fields[7], "Disk 90% full") {
+		t.Errorf("Unexpected warning entry: %v", fields)
+	}
 }
 
-func TestTwoNotifiers(t *testing.T) {
-	old := ignoreStdOut(t)
-	defer func() { os.Stdout = old }()
+func TestLogAllByLevel(t *testing.T) {
 
-	logfile := os.Getenv("HOME") + "/TestTwoNotifiers.log"
+	logfile := os.Getenv("HOME") + "/TestLogAllByLevel.log"
 	defer os.Remove(logfile)
 
-	notifier1 := NewNotifier("", "", true, true, true, 100, logfile, os.Stdout)
-	notifier2 := NewNotifier("", "", true, true, true, 100, logfile, os.Stdout) // logfile will not be used
+	notifier := NewNotifier("MyService", "MyServiceInstance", false, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
 
-	n1Endpoints := len(notifier1.endpoints.endpointsPtr)
-	n2Endpoints := len(notifier2.endpoints.endpointsPtr)
+	fail := notifier.Failure("TestLogAllByLevel")
+	notifier.Sender("TestLogAllByLevel")("A message")
+	fail(0, "A message notification")
+	fail(200, "An OK status")
+	fail(3, "An error")
+	notifier.Exit()
 
-	if n1Endpoints != 2 || n2Endpoints == 2 {
-		t.Error("Failed to assign logfile for only one notifier " + strconv.Itoa(n1Endpoints) + " " + strconv.Itoa(n2Endpoints))
+	lines := readLogLines(t, logfile)
+	if len(lines) != 1 || !strings.Contains(lines[0], "An error") {
+		t.Errorf("Expected only the error to be logged, got %v", lines)
 	}
-
 }
 
-func expectNotifier(no *Notifier) error {
-	fail := no.Failure("test")
-	return fail(3, "Hello, World!")
+func TestMinLevel(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestMinLevel.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	if err := notifier.SetMinLevel("DBG"); err == nil {
+		t.Error("An unknown level should be rejected")
+	}
+	if err := notifier.SetMinLevel("WRN"); err != nil {
+		t.Fatal("Failed setting the threshold: " + err.Error())
+	}
+	go notifier.Run()
+	notifier.WarmUp()
+
+	// The threshold applies when the notes are logged
+	notifier.SendSync("TestMinLevel", "A message")
+	notifier.SendSync("TestMinLevel", New(5, "A warning"))
+	notifier.SendSync("TestMinLevel", New(3, "An error"))
+
+	// The threshold can be changed on a running notifier
+	notifier.SetMinLevel("ERR")
+	notifier.SendSync("TestMinLevel", New(5, "Another warning"))
+	notifier.SendSync("TestMinLevel", New(3, "Another error"))
+	notifier.SetMinLevel("")
+	notifier.SendSync("TestMinLevel", "Another message")
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	expected := []string{"A warning", "An error", "Another error", "Another message"}
+	if len(lines) != len(expected)+1 {
+		t.Fatalf("Expected %d entries, got %v", len(expected)+1, lines)
+	}
+	for i, message := range expected {
+		if !strings.Contains(lines[i], message) {
+			t.Errorf("Expected '%s' in line %d, got '%s'", message, i+1, lines[i])
+		}
+	}
 }
 
-func TestNotifierStruct(t *testing.T) {
-	old := ignoreStdOut(t)
-	defer func() { os.Stdout = old }()
+func TestSetLogAll(t *testing.T) {
 
-	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, os.Stdout)
+	logfile := os.Getenv("HOME") + "/TestSetLogAll.log"
+	defer os.Remove(logfile)
 
-	if expectNotifier(notifier).Error()[0:13] != "Hello, World!" {
-		t.Error("Failed passing notifier as function argument")
+	notifier := NewNotifier("MyService", "MyServiceInstance", false, false, false, 100, logfile)
+	go notifier.Run()
+	notifier.WarmUp()
+
+	notifier.SendSync("TestSetLogAll", "A skipped message")
+	notifier.SetLogAll(true)
+	notifier.SendSync("TestSetLogAll", "A logged message")
+
+	// Verbosity can be toggled while notes are logged
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			notifier.SetLogAll(i%2 == 0)
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		notifier.Sender("TestSetLogAll")(New(3, "An error"))
 	}
+	<-done
 
+	notifier.SetLogAll(false)
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 101 || !strings.Contains(lines[0], "A logged message") {
+		t.Errorf("Expected the logged message and 100 errors, got %d entries", len(lines))
+	}
+}
+
+func TestWriter(t *testing.T) {
+
+	logfile := os.Getenv("HOME") + "/TestWriter.log"
+	defer os.Remove(logfile)
+
+	notifier := NewNotifier("MyService", "MyServiceInstance", true, false, false, 100, logfile)
+	w := notifier.Writer("legacy")
+
+	fmt.Fprint(w, "first line\nsecond ")
+	fmt.Fprint(w, "line\r\n")
+	fmt.Fprint(w, "incomplete")
+
+	go notifier.Run()
+	notifier.WarmUp()
+	notifier.Exit()
+
+	lines := readLogLines(t, logfile)
+	if len(lines) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(lines))
+	}
+	if !strings.HasSuffix(lines[0], "legacy\tMSG\t0\tGeneralMessage\tfirst line") || !strings.HasSuffix(lines[1], "\tsecond line") {
+		t.Errorf("Unexpected entries: %v", lines[:2])
+	}
 }